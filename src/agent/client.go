@@ -0,0 +1,334 @@
+// Package agent is a client of the redis-persist agent protocol: json-rpc 2.0
+// messages, each prefixed by its length as a 4-byte big-endian integer.
+//
+// A Client keeps a small pool of connections. Calls on one connection are
+// pipelined and matched to responses by request id, and a broken connection
+// is redialed on the next call.
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ClientClosed = errors.New("client closed")
+
+// Error is an error returned by the agent
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("agent error %d: %s", e.Code, e.Message)
+}
+
+type Options struct {
+	PoolSize    int           // connections, default 4
+	DialTimeout time.Duration // default 5s
+	Timeout     time.Duration // per call if ctx has no deadline, 0 means no timeout
+	Token       string        // sent by Auth on every new connection if not empty
+	Tls         *tls.Config   // dial with tls if not nil
+	Source      string        // call methods on this source instead of the default one
+	MaxFrame    int           // max bytes of a response, default 64MB
+}
+
+type request struct {
+	Jsonrpc string      `json:"jsonrpc"`
+	Id      uint64      `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type response struct {
+	Id     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+type result struct {
+	resp *response
+	err  error
+}
+
+type conn struct {
+	c        net.Conn
+	maxFrame int
+	wmu      sync.Mutex
+	mu       sync.Mutex
+	pending  map[uint64]chan result
+	err      error
+}
+
+func (cn *conn) broken() bool {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	return cn.err != nil
+}
+
+func (cn *conn) register(id uint64, ch chan result) error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if cn.err != nil {
+		return cn.err
+	}
+	cn.pending[id] = ch
+	return nil
+}
+
+func (cn *conn) unregister(id uint64) {
+	cn.mu.Lock()
+	delete(cn.pending, id)
+	cn.mu.Unlock()
+}
+
+// fail all pending calls, the connection can't be used any more
+func (cn *conn) fail(err error) {
+	cn.mu.Lock()
+	if cn.err == nil {
+		cn.err = err
+		cn.c.Close()
+	}
+	pending := cn.pending
+	cn.pending = make(map[uint64]chan result)
+	cn.mu.Unlock()
+
+	for _, ch := range pending {
+		ch <- result{err: err}
+	}
+}
+
+func (cn *conn) readLoop() {
+	reader := bufio.NewReader(cn.c)
+	for {
+		var sz uint32
+		if err := binary.Read(reader, binary.BigEndian, &sz); err != nil {
+			cn.fail(err)
+			return
+		}
+		if int64(sz) > int64(cn.maxFrame) {
+			cn.fail(fmt.Errorf("response of %d bytes is over %d", sz, cn.maxFrame))
+			return
+		}
+		buf := make([]byte, sz)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			cn.fail(err)
+			return
+		}
+
+		var resp response
+		if err := json.Unmarshal(buf, &resp); err != nil {
+			cn.fail(err)
+			return
+		}
+		cn.mu.Lock()
+		ch, ok := cn.pending[resp.Id]
+		delete(cn.pending, resp.Id)
+		cn.mu.Unlock()
+		// the caller may have given up
+		if ok {
+			ch <- result{resp: &resp}
+		}
+	}
+}
+
+func (cn *conn) write(chunk []byte, deadline time.Time) error {
+	cn.wmu.Lock()
+	defer cn.wmu.Unlock()
+	cn.c.SetWriteDeadline(deadline)
+	_, err := cn.c.Write(chunk)
+	return err
+}
+
+type Client struct {
+	addr   string
+	opts   Options
+	mu     sync.Mutex
+	conns  []*conn
+	dials  []sync.Mutex // one redial at a time per slot, without holding mu
+	next   uint32
+	id     uint64
+	closed bool
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: c.opts.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.Tls != nil {
+		tc := tls.Client(nc, c.opts.Tls)
+		deadline, _ := ctx.Deadline()
+		tc.SetDeadline(deadline)
+		if err = tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		tc.SetDeadline(time.Time{})
+		nc = tc
+	}
+	cn := &conn{c: nc, maxFrame: c.opts.MaxFrame, pending: make(map[uint64]chan result)}
+	go cn.readLoop()
+	if c.opts.Token != "" {
+		if err = c.roundTrip(ctx, cn, "Auth", c.opts.Token, nil); err != nil {
+			cn.fail(err)
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (c *Client) slot(i int) (*conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ClientClosed
+	}
+	return c.conns[i], nil
+}
+
+// pick a connection round robin, redial the broken one. A slow dial only
+// holds up calls on its own slot
+func (c *Client) getConn(ctx context.Context) (*conn, error) {
+	i := int(atomic.AddUint32(&c.next, 1)) % len(c.conns)
+	cn, err := c.slot(i)
+	if err != nil || (cn != nil && !cn.broken()) {
+		return cn, err
+	}
+
+	c.dials[i].Lock()
+	defer c.dials[i].Unlock()
+	// redialed while waiting
+	if cn, err = c.slot(i); err != nil || (cn != nil && !cn.broken()) {
+		return cn, err
+	}
+	if cn, err = c.dial(ctx); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		cn.fail(ClientClosed)
+		return nil, ClientClosed
+	}
+	c.conns[i] = cn
+	return cn, nil
+}
+
+// Call invokes method with params and decodes the result into reply,
+// reply may be nil to discard the result.
+func (c *Client) Call(ctx context.Context, method string, params interface{}, reply interface{}) error {
+	if _, ok := ctx.Deadline(); !ok && c.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+
+	cn, err := c.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	if c.opts.Source != "" {
+		method = c.opts.Source + "." + method
+	}
+	return c.roundTrip(ctx, cn, method, params, reply)
+}
+
+func (c *Client) roundTrip(ctx context.Context, cn *conn, method string, params interface{}, reply interface{}) error {
+	id := atomic.AddUint64(&c.id, 1)
+	body, err := json.Marshal(&request{"2.0", id, method, params})
+	if err != nil {
+		return err
+	}
+	chunk := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(chunk, uint32(len(body)))
+	copy(chunk[4:], body)
+
+	ch := make(chan result, 1)
+	if err = cn.register(id, ch); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err = cn.write(chunk, deadline); err != nil {
+		cn.fail(err)
+		return err
+	}
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return r.err
+		}
+		if r.resp.Error != nil {
+			return r.resp.Error
+		}
+		if reply == nil {
+			return nil
+		}
+		return json.Unmarshal(r.resp.Result, reply)
+	case <-ctx.Done():
+		cn.unregister(id)
+		return ctx.Err()
+	}
+}
+
+// Get returns fields of key, nil if key doesn't exist
+func (c *Client) Get(ctx context.Context, key string) (data map[string]string, err error) {
+	err = c.Call(ctx, "Get", key, &data)
+	return
+}
+
+// MGet returns fields of keys, missing keys are mapped to nil
+func (c *Client) MGet(ctx context.Context, keys []string) (data map[string]map[string]string, err error) {
+	err = c.Call(ctx, "MGet", keys, &data)
+	return
+}
+
+// Scan returns at most count keys with prefix from cursor, next is empty at the end
+func (c *Client) Scan(ctx context.Context, prefix, cursor string, count int) (keys []string, next string, err error) {
+	var reply struct {
+		Keys   []string `json:"keys"`
+		Cursor string   `json:"cursor"`
+	}
+	params := map[string]interface{}{"prefix": prefix, "cursor": cursor, "count": count}
+	if err = c.Call(ctx, "Scan", params, &reply); err != nil {
+		return
+	}
+	return reply.Keys, reply.Cursor, nil
+}
+
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cn := range c.conns {
+		if cn != nil {
+			cn.fail(ClientClosed)
+		}
+	}
+}
+
+func NewClient(addr string, opts Options) *Client {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 4
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.MaxFrame <= 0 {
+		opts.MaxFrame = 64 * 1024 * 1024
+	}
+	return &Client{addr: addr, opts: opts, conns: make([]*conn, opts.PoolSize), dials: make([]sync.Mutex, opts.PoolSize)}
+}
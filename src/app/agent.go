@@ -3,78 +3,251 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"io"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
 )
 
 type AgentHandler func(ud interface{}, params interface{}) (interface{}, error)
 
+// handler which keeps pushing messages after the response, such as Watch
+type StreamHandler func(ud interface{}, params interface{}, sess *AgentSession) (interface{}, error)
+
 type AgentSvr struct {
 	ln      net.Listener
-	db      *Leveldb
+	sources map[string]*Source // methods on them are called as <source>.<method>
 	handers map[string][]interface{}
+	httpSvr *http.Server
+	mu      sync.Mutex // guards ln and stopped, Serve and Stop may race
+	stopped bool
 	wg      sync.WaitGroup
 }
 
-type Request struct {
-	Id     uint32
-	Method string
-	Params interface{}
+const (
+	ERR_PARSE            = -32700
+	ERR_INVALID_REQUEST  = -32600
+	ERR_METHOD_NOT_FOUND = -32601
+	ERR_INVALID_PARAMS   = -32602
+	ERR_INTERNAL         = -32603
+	// implementation defined server errors
+	ERR_UNAUTHORIZED      = -32001
+	ERR_PERMISSION_DENIED = -32002
+	ERR_CHANGES_TRIMMED   = -32003 // watch since a seq which is gone from the change log
+)
+
+type AgentError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
-type Response struct {
-	Id     uint32      `json:"id"`
-	Result interface{} `json:"result"`
-	Error  interface{} `json:"error"`
+func (e *AgentError) Error() string {
+	return e.Message
 }
 
-func (self *AgentSvr) dispatchRequst(conn *net.TCPConn, req *Request) {
-	defer func() {
-		if err := recover(); err != nil {
-			Error("handle agent connection:%v failed:%v", conn.RemoteAddr(), err)
-		}
-	}()
-	cb, ok := self.handers[req.Method]
-	if ok {
-		ud := cb[0]
-		handler := cb[1].(AgentHandler)
-		var resp Response
-		resp.Id = req.Id
-		if result, err := handler(ud, req.Params); err != nil {
-			resp.Error = err
-		} else {
-			resp.Result = result
+func invalidParams(msg string) *AgentError {
+	return &AgentError{ERR_INVALID_PARAMS, msg}
+}
+
+func toAgentError(err error) *AgentError {
+	if e, ok := err.(*AgentError); ok {
+		return e
+	}
+	return &AgentError{ERR_INTERNAL, err.Error()}
+}
+
+const (
+	AGENT_MAX_FRAME = 64 * 1024 * 1024 // default of agent.maxframe
+	// enough for Auth, checked before the frame is allocated
+	AGENT_NOAUTH_MAX_FRAME = 16 * 1024
+)
+
+func frame(body []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.BigEndian, uint32(len(body)))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func (self *AgentSvr) call(method string, params interface{}, sess *AgentSession) (result interface{}, err *AgentError) {
+	if method == "Auth" {
+		return sess.auth(params)
+	}
+	role := sess.Role()
+	if role == ROLE_NONE {
+		err = &AgentError{ERR_UNAUTHORIZED, AuthRequired.Error()}
+		return
+	}
+	var src *Source
+	if i := strings.Index(method, "."); i >= 0 {
+		if src = self.sources[method[:i]]; src == nil {
+			err = &AgentError{ERR_METHOD_NOT_FOUND, "unknown source: " + method[:i]}
+			return
 		}
-		body, err := json.Marshal(resp)
-		if err != nil {
-			Panic("marshal response conn:%v, failed:%v", conn.RemoteAddr(), err)
+		method = method[i+1:]
+	}
+	if role < requiredRole(methodRoles, method) {
+		Error("agent denied method:%s", method)
+		err = &AgentError{ERR_PERMISSION_DENIED, PermissionDenied.Error()}
+		return
+	}
+	cb, ok := self.handers[method]
+	if !ok {
+		Error("unknown method:%s", method)
+		err = &AgentError{ERR_METHOD_NOT_FOUND, "unknown method: " + method}
+		return
+	}
+	ud := cb[0]
+	if src != nil {
+		ud = src
+	}
+	var e error
+	switch handler := cb[1].(type) {
+	case AgentHandler:
+		result, e = handler(ud, params)
+	case StreamHandler:
+		if sess.pending == nil {
+			err = &AgentError{ERR_INVALID_REQUEST, method + " is only available on tcp connection"}
+			return
 		}
+		result, e = handler(ud, params, sess)
+	}
+	if e != nil {
+		result = nil
+		err = toAgentError(e)
+	}
+	return
+}
+
+// always put exactly one chunk into slot, nil if there is nothing to reply
+func (self *AgentSvr) dispatchRequest(body []byte, slot chan []byte, sess *AgentSession) {
+	var chunk []byte
+	defer func() {
+		slot <- chunk
+	}()
+	if reply := self.handleMessage(body, sess); reply != nil {
+		chunk = frame(reply)
+	}
+}
+
+// AgentSession keeps the role of a connection and lets stream handlers push
+// messages to it, pending is nil for http requests
+type AgentSession struct {
+	mu      sync.Mutex
+	pending chan chan []byte
+	closed  bool
+	quit    chan bool
+	pushers sync.WaitGroup // pushes in progress, pending is closed after them
+	role    int
+}
+
+func (sess *AgentSession) Role() int {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.role
+}
+
+// params: token
+// result: role name
+func (sess *AgentSession) auth(params interface{}) (result interface{}, err *AgentError) {
+	token, ok := params.(string)
+	if !ok {
+		err = invalidParams("params should be string")
+		return
+	}
+	if !authEnabled() {
+		result = roleNames[ROLE_ADMIN]
+		return
+	}
+	name, role, e := authenticate(token)
+	sess.mu.Lock()
+	sess.role = role
+	sess.mu.Unlock()
+	if e != nil {
+		Error("agent auth failed")
+		err = &AgentError{ERR_UNAUTHORIZED, e.Error()}
+		return
+	}
+	Info("agent auth as %s(%s)", name, roleNames[role])
+	result = roleNames[role]
+	return
+}
+
+// push a message after all queued responses, return false if the connection is closed.
+// It blocks while the connection has too many in-flight requests, without the lock
+// so the session can still be closed
+func (sess *AgentSession) Push(body []byte) bool {
+	sess.mu.Lock()
+	if sess.closed {
+		sess.mu.Unlock()
+		return false
+	}
+	sess.pushers.Add(1)
+	sess.mu.Unlock()
+	defer sess.pushers.Done()
+
+	slot := make(chan []byte, 1)
+	slot <- frame(body)
+	select {
+	case sess.pending <- slot:
+		return true
+	case <-sess.quit:
+		return false
+	}
+}
+
+func (sess *AgentSession) Quit() chan bool {
+	return sess.quit
+}
+
+func (sess *AgentSession) close() {
+	sess.mu.Lock()
+	sess.closed = true
+	close(sess.quit)
+	sess.mu.Unlock()
+	sess.pushers.Wait()
+	close(sess.pending)
+}
 
-		length := uint32(len(body))
-		buf := bytes.NewBuffer(nil)
-		binary.Write(buf, binary.BigEndian, length)
-		buf.Write(body)
-		chunk := buf.Bytes()
-		if _, err = conn.Write(chunk); err != nil {
-			Panic("write response conn:%v, failed:%v", conn.RemoteAddr(), err)
+// write responses in the order of requests
+func (self *AgentSvr) writeResponses(conn net.Conn, pending chan chan []byte, done chan bool) {
+	failed := false
+	for slot := range pending {
+		chunk := <-slot
+		if failed || chunk == nil {
+			continue
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			Error("write response conn:%v, failed:%v", conn.RemoteAddr(), err)
+			// unblock the reader
+			conn.Close()
+			failed = true
 		}
-	} else {
-		Error("unknown request:%v", req)
 	}
+	close(done)
 }
 
-func (self *AgentSvr) handleConnection(conn *net.TCPConn) {
+func (self *AgentSvr) handleConnection(conn net.Conn) {
 	defer conn.Close()
 	defer self.wg.Done()
+
+	Info("new agent connection:%v", conn.RemoteAddr())
+	// bounded in-flight requests, reader blocks when it's full. the writer
+	// holds one slot out of the channel while it waits on it
+	inflight := setting.Agent.MaxInflight - 1
+	if inflight < 0 {
+		inflight = 0
+	}
+	pending := make(chan chan []byte, inflight)
+	sess := &AgentSession{pending: pending, quit: make(chan bool), role: defaultRole()}
+	done := make(chan bool)
+	go self.writeResponses(conn, pending, done)
 	defer func() {
-		if err := recover(); err != nil {
-			Error("handle agent connection:%v failed:%v", conn.RemoteAddr(), err)
-		}
+		sess.close()
+		<-done
 	}()
 
-	Info("new agent connection:%v", conn.RemoteAddr())
 	for {
 		var sz uint32
 		err := binary.Read(conn, binary.BigEndian, &sz)
@@ -82,37 +255,57 @@ func (self *AgentSvr) handleConnection(conn *net.TCPConn) {
 			Error("read conn failed:%v, err:%v", conn.RemoteAddr(), err)
 			break
 		}
+		limit := setting.Agent.MaxFrame
+		if sess.Role() == ROLE_NONE {
+			limit = AGENT_NOAUTH_MAX_FRAME
+		}
+		if int64(sz) > int64(limit) {
+			Error("frame of %d bytes is over %d, close conn:%v", sz, limit, conn.RemoteAddr())
+			break
+		}
 		buf := make([]byte, sz)
 		_, err = io.ReadFull(conn, buf)
 		if err != nil {
 			Error("read conn failed:%v, err:%v", conn.RemoteAddr(), err)
 			break
 		}
-		var req Request
-		if err = json.Unmarshal(buf, &req); err != nil {
-			Error("parse request failed:%v, err:%v", conn.RemoteAddr(), err)
-		}
 
-		go self.dispatchRequst(conn, &req)
+		slot := make(chan []byte, 1)
+		pending <- slot
+		if sess.Role() == ROLE_NONE {
+			// nothing runs concurrently before auth, so requests pipelined
+			// after Auth see its result
+			self.dispatchRequest(buf, slot, sess)
+		} else {
+			go self.dispatchRequest(buf, slot, sess)
+		}
 	}
 }
 
 func (self *AgentSvr) Start() {
-	self.wg.Add(1)
-	defer self.wg.Done()
-
-	ln, err := net.Listen("tcp", setting.Agent.Addr)
+	ln, err := listen(setting.Agent.Addr, &setting.Agent.Tls)
 	if err != nil {
 		Panic("resolve local addr failed:%s", err.Error())
 	}
 	Info("start agent succeed:%s", setting.Agent.Addr)
+	self.Serve(ln)
+}
 
-	// register handler
-	self.Register("Get", self, handlerGet)
-
+// accept connections on ln until it's closed by Stop
+func (self *AgentSvr) Serve(ln net.Listener) {
+	self.mu.Lock()
+	if self.stopped {
+		self.mu.Unlock()
+		ln.Close()
+		return
+	}
 	self.ln = ln
+	self.wg.Add(1)
+	self.mu.Unlock()
+	defer self.wg.Done()
+
 	for {
-		conn, err := self.ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			Error("accept failed:%v", err)
 			if opErr, ok := err.(*net.OpError); ok {
@@ -123,14 +316,20 @@ func (self *AgentSvr) Start() {
 			continue
 		}
 		self.wg.Add(1)
-		go self.handleConnection(conn.(*net.TCPConn))
+		go self.handleConnection(conn)
 	}
 }
 
 func (self *AgentSvr) Stop() {
+	self.mu.Lock()
+	self.stopped = true
 	if self.ln != nil {
 		self.ln.Close()
 	}
+	self.mu.Unlock()
+	if self.httpSvr != nil {
+		self.httpSvr.Close()
+	}
 	self.wg.Wait()
 }
 
@@ -138,28 +337,205 @@ func (self *AgentSvr) Register(cmd string, ud interface{}, handler AgentHandler)
 	self.handers[cmd] = []interface{}{ud, handler}
 }
 
+func (self *AgentSvr) RegisterStream(cmd string, ud interface{}, handler StreamHandler) {
+	self.handers[cmd] = []interface{}{ud, handler}
+}
+
 func handlerGet(ud interface{}, params interface{}) (result interface{}, err error) {
-	agent := ud.(*AgentSvr)
-	key := params.(string)
+	src := ud.(*Source)
+	key, ok := params.(string)
+	if !ok {
+		err = invalidParams("params should be string")
+		return
+	}
 	Info("agent get:%v", key)
-	chunk, err := agent.db.Get([]byte(key))
-	if chunk == nil || err != nil {
+	rec, err := src.db.GetRecord(key)
+	if rec == nil || err != nil {
 		Error("query key:%s failed:%v", key, err)
 		return
 	}
-	var data map[string]string
-	if err = json.Unmarshal(chunk, &data); err != nil {
-		Error("unmarshal key:%s failed:%v", key, err)
+
+	result = rec.Fields
+	return
+}
+
+func toStrings(params interface{}) (strs []string, err error) {
+	items, ok := params.([]interface{})
+	if !ok {
+		err = invalidParams("params should be array of string")
+		return
+	}
+	strs = make([]string, len(items))
+	for i, item := range items {
+		if strs[i], ok = item.(string); !ok {
+			err = invalidParams("params should be array of string")
+			return
+		}
+	}
+	return
+}
+
+// params: [key, ...]
+// result: {key: {field: value, ...} or null, ...}
+func handlerMGet(ud interface{}, params interface{}) (result interface{}, err error) {
+	src := ud.(*Source)
+	keys, err := toStrings(params)
+	if err != nil {
 		return
 	}
+	Info("agent mget:%d keys", len(keys))
+	data := make(map[string]map[string]string)
+	for _, key := range keys {
+		var rec *Record
+		if rec, err = src.db.GetRecord(key); err != nil {
+			Error("query key:%s failed:%v", key, err)
+			return
+		}
+		if rec != nil {
+			data[key] = rec.Fields
+		} else {
+			data[key] = nil
+		}
+	}
+	result = data
+	return
+}
 
+// params: [key, ...]
+// result: {key: true or false, ...}
+func handlerExists(ud interface{}, params interface{}) (result interface{}, err error) {
+	src := ud.(*Source)
+	keys, err := toStrings(params)
+	if err != nil {
+		return
+	}
+	data := make(map[string]bool)
+	for _, key := range keys {
+		var version []byte
+		if version, err = src.db.Get([]byte(indexKey(key))); err != nil {
+			return
+		}
+		data[key] = version != nil
+	}
 	result = data
 	return
 }
 
-func NewAgent(db *Leveldb) *AgentSvr {
+// params: {"key": key, "fields": [field, ...]}
+// result: {field: value, ...} or null, missing fields are omitted
+func handlerGetFields(ud interface{}, params interface{}) (result interface{}, err error) {
+	src := ud.(*Source)
+	args, ok := params.(map[string]interface{})
+	if !ok {
+		err = invalidParams("params should be object")
+		return
+	}
+	key, _ := args["key"].(string)
+	fields, err := toStrings(args["fields"])
+	if err != nil {
+		return
+	}
+	rec, err := src.db.GetRecord(key)
+	if rec == nil || err != nil {
+		return
+	}
+	data := make(map[string]string)
+	for _, field := range fields {
+		if value, ok := rec.Fields[field]; ok {
+			data[field] = value
+		}
+	}
+	result = data
+	return
+}
+
+// params: key
+// result: version string or null
+func handlerVersion(ud interface{}, params interface{}) (result interface{}, err error) {
+	src := ud.(*Source)
+	key, ok := params.(string)
+	if !ok {
+		err = invalidParams("params should be string")
+		return
+	}
+	version, err := src.db.Get([]byte(indexKey(key)))
+	if version == nil || err != nil {
+		return
+	}
+	result = string(version)
+	return
+}
+
+type ScanResult struct {
+	Keys   []string `json:"keys"`
+	Cursor string   `json:"cursor"`
+}
+
+// upper bound of keys per page of agent, http and resp scans
+const MAX_SCAN_COUNT int = 1000
+
+// params: {"prefix": prefix, "cursor": cursor, "count": count}
+// result: {"keys": [key, ...], "cursor": cursor}, an empty cursor means the end
+func handlerScan(ud interface{}, params interface{}) (result interface{}, err error) {
+	src := ud.(*Source)
+	args, _ := params.(map[string]interface{})
+	prefix, _ := args["prefix"].(string)
+	cursor, _ := args["cursor"].(string)
+	count := 100
+	if n, ok := args["count"].(float64); ok && n > 0 {
+		count = int(n)
+	}
+	if count > MAX_SCAN_COUNT {
+		count = MAX_SCAN_COUNT
+	}
+
+	it := src.db.NewIterator()
+	defer it.Close()
+
+	start := []byte(indexKey(prefix))
+	from := start
+	if cursor != "" {
+		from = []byte(indexKey(cursor))
+	}
+	scan := ScanResult{Keys: make([]string, 0, count)}
+	for it.Seek(from); it.Valid() && bytes.HasPrefix(it.Key(), start); it.Next() {
+		key := string(it.Key()[INDEX_KEY_LEN:])
+		// the cursor is the first key of next page
+		if len(scan.Keys) >= count {
+			scan.Cursor = key
+			break
+		}
+		scan.Keys = append(scan.Keys, key)
+	}
+	if err = it.GetError(); err != nil {
+		return
+	}
+	result = scan
+	return
+}
+
+// methods without a source work on the first one
+func NewAgent(sources []*Source) *AgentSvr {
 	agent := new(AgentSvr)
-	agent.db = db
+	agent.sources = make(map[string]*Source)
+	for _, src := range sources {
+		agent.sources[src.name] = src
+	}
 	agent.handers = make(map[string][]interface{})
+	if setting.Agent.HttpAddr != "" {
+		agent.httpSvr = &http.Server{Handler: agent}
+	}
+
+	// register handler
+	src := sources[0]
+	agent.Register("Get", src, handlerGet)
+	agent.Register("MGet", src, handlerMGet)
+	agent.Register("Exists", src, handlerExists)
+	agent.Register("GetFields", src, handlerGetFields)
+	agent.Register("Version", src, handlerVersion)
+	agent.Register("Scan", src, handlerScan)
+	agent.Register("Find", src, handlerFind)
+	agent.Register("Load", src, handlerLoad)
+	agent.RegisterStream("Watch", src, handlerWatch)
 	return agent
 }
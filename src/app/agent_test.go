@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHandlerScanCount(t *testing.T) {
+	db := newTestLeveldb(t, nil)
+	for i := 0; i < MAX_SCAN_COUNT+10; i++ {
+		db.PutRecord(&Record{Key: fmt.Sprintf("uid:%04d", i), Version: "1", Fields: map[string]string{}})
+	}
+	src := &Source{db: db}
+
+	for count, expect := range map[float64]int{0: 100, -1: 100, 10: 10, 1e9: MAX_SCAN_COUNT} {
+		result, err := handlerScan(src, map[string]interface{}{"count": count})
+		if err != nil {
+			t.Fatalf("scan failed:%v", err)
+		}
+		scan := result.(ScanResult)
+		if len(scan.Keys) != expect || scan.Cursor != fmt.Sprintf("uid:%04d", expect) {
+			t.Errorf("count:%v, expect %d keys, got %d, cursor:%s", count, expect, len(scan.Keys), scan.Cursor)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	ROLE_NONE = iota
+	ROLE_READ
+	ROLE_OPERATOR
+	ROLE_ADMIN
+)
+
+var roleNames = []string{"none", "read", "operator", "admin"}
+
+var PermissionDenied = errors.New("permission denied")
+var AuthFailed = errors.New("invalid token")
+var AuthRequired = errors.New("auth required")
+
+type TlsConfig struct {
+	Cert     string
+	Key      string
+	ClientCa string // require and verify client certificates if set
+}
+
+type Credential struct {
+	Name  string
+	Token string
+	Role  string // read, operator or admin
+}
+
+// authentication is disabled if there is no credential
+type AuthConfig struct {
+	Credentials []Credential
+}
+
+// a typo in a role would lock the credential out silently, refuse it instead
+func (c *AuthConfig) setDefault() error {
+	tokens := make(map[string]bool)
+	for _, cred := range c.Credentials {
+		if cred.Token == "" {
+			return fmt.Errorf("credential %s without token", cred.Name)
+		}
+		if tokens[cred.Token] {
+			return fmt.Errorf("credential %s reuses a token", cred.Name)
+		}
+		tokens[cred.Token] = true
+		if parseRole(cred.Role) == ROLE_NONE {
+			return fmt.Errorf("credential %s has unknown role %q", cred.Name, cred.Role)
+		}
+	}
+	return nil
+}
+
+// manager commands not listed here need admin
+var commandRoles = map[string]int{
+	"auth":        ROLE_NONE,
+	"help":        ROLE_READ,
+	"info":        ROLE_READ,
+	"sizes":       ROLE_READ,
+	"durability":  ROLE_READ,
+	"dump":        ROLE_READ,
+	"count":       ROLE_READ,
+	"diff":        ROLE_READ,
+	"keys":        ROLE_READ,
+	"check_all":   ROLE_READ,
+	"fast_check":  ROLE_READ,
+	"find":        ROLE_READ,
+	"sinks":       ROLE_READ,
+	"conflicts":   ROLE_READ,
+	"namespaces":  ROLE_READ,
+	"sources":     ROLE_READ,
+	"sync":        ROLE_OPERATOR,
+	"sync_all":    ROLE_OPERATOR,
+	"restore_one": ROLE_OPERATOR,
+	"compact":     ROLE_OPERATOR,
+	"reindex":     ROLE_OPERATOR,
+	"migrate":     ROLE_OPERATOR,
+	"evict":       ROLE_OPERATOR,
+}
+
+// agent methods not listed here need admin
+var methodRoles = map[string]int{
+	"Auth":      ROLE_NONE,
+	"Get":       ROLE_READ,
+	"MGet":      ROLE_READ,
+	"Exists":    ROLE_READ,
+	"GetFields": ROLE_READ,
+	"Version":   ROLE_READ,
+	"Scan":      ROLE_READ,
+	"Find":      ROLE_READ,
+	"Watch":     ROLE_READ,
+	"Load":      ROLE_OPERATOR,
+}
+
+func requiredRole(roles map[string]int, name string) int {
+	if role, ok := roles[name]; ok {
+		return role
+	}
+	return ROLE_ADMIN
+}
+
+func authEnabled() bool {
+	return len(setting.Auth.Credentials) > 0
+}
+
+// role of a new connection
+func defaultRole() int {
+	if authEnabled() {
+		return ROLE_NONE
+	}
+	return ROLE_ADMIN
+}
+
+func parseRole(name string) int {
+	for i, n := range roleNames {
+		if n == name {
+			return i
+		}
+	}
+	return ROLE_NONE
+}
+
+func authenticate(token string) (name string, role int, err error) {
+	for _, c := range setting.Auth.Credentials {
+		if subtle.ConstantTimeCompare([]byte(c.Token), []byte(token)) == 1 {
+			return c.Name, parseRole(c.Role), nil
+		}
+	}
+	err = AuthFailed
+	return
+}
+
+// role of a http request from "Authorization: Bearer <token>"
+func httpRole(r *http.Request) int {
+	if !authEnabled() {
+		return ROLE_ADMIN
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ROLE_NONE
+	}
+	_, role, err := authenticate(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		return ROLE_NONE
+	}
+	return role
+}
+
+// listen on tcp, or tls if cert is configured
+func listen(addr string, config *TlsConfig) (net.Listener, error) {
+	if config == nil || config.Cert == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		return nil, err
+	}
+	tls_config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if config.ClientCa != "" {
+		pem, err := ioutil.ReadFile(config.ClientCa)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate in " + config.ClientCa)
+		}
+		tls_config.ClientCAs = pool
+		tls_config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tls.Listen("tcp", addr, tls_config)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAuthConfig(t *testing.T) {
+	valid := AuthConfig{Credentials: []Credential{
+		{Name: "a", Token: "t1", Role: "read"},
+		{Name: "b", Token: "t2", Role: "operator"},
+		{Name: "c", Token: "t3", Role: "admin"},
+	}}
+	if err := valid.setDefault(); err != nil {
+		t.Errorf("valid credentials rejected:%v", err)
+	}
+
+	invalid := map[string]Credential{
+		"unknown role": {Name: "x", Token: "t4", Role: "reader"},
+		"none role":    {Name: "x", Token: "t4", Role: "none"},
+		"empty role":   {Name: "x", Token: "t4"},
+		"no token":     {Name: "x", Role: "read"},
+		"reused token": {Name: "x", Token: "t1", Role: "admin"},
+	}
+	for name, cred := range invalid {
+		config := AuthConfig{Credentials: append([]Credential{}, valid.Credentials...)}
+		config.Credentials = append(config.Credentials, cred)
+		if err := config.setDefault(); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
+
+func TestExportNeedsAdmin(t *testing.T) {
+	for _, cmd := range []string{"export", "import", "restore_all"} {
+		if role := requiredRole(commandRoles, cmd); role != ROLE_ADMIN {
+			t.Errorf("%s needs %s", cmd, roleNames[role])
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// change log entry: INTERNAL_PREFIX '$' seq(8 bytes, big endian) => json of ChangeEvent
+const CHANGE_KEY_PREFIX string = INTERNAL_PREFIX + "$"
+const WATCHER_BUFFER int = 1024
+
+var AgentSessionClosed = errors.New("agent session closed")
+
+var CHANGE_KEY_START = []byte(CHANGE_KEY_PREFIX)
+var CHANGE_KEY_END = []byte(CHANGE_KEY_PREFIX + "\xff\xff\xff\xff\xff\xff\xff\xff\xff")
+
+type ChangeEvent struct {
+	Seq       uint64   `json:"seq"`
+	Key       string   `json:"key"`
+	Version   string   `json:"version"`
+	Timestamp int64    `json:"timestamp"`
+	Fields    []string `json:"fields"` // changed or removed fields
+}
+
+func changeKey(seq uint64) []byte {
+	key := make([]byte, len(CHANGE_KEY_PREFIX)+8)
+	copy(key, CHANGE_KEY_PREFIX)
+	binary.BigEndian.PutUint64(key[len(CHANGE_KEY_PREFIX):], seq)
+	return key
+}
+
+func changedFields(old, rec *Record) []string {
+	fields := make([]string, 0)
+	for k, v := range rec.Fields {
+		if old == nil {
+			fields = append(fields, k)
+		} else if old_v, ok := old.Fields[k]; !ok || old_v != v {
+			fields = append(fields, k)
+		}
+	}
+	if old != nil {
+		for k := range old.Fields {
+			if _, ok := rec.Fields[k]; !ok {
+				fields = append(fields, k)
+			}
+		}
+	}
+	return fields
+}
+
+type watcher struct {
+	prefix string
+	ch     chan *ChangeEvent
+}
+
+// ChangeHub hands out sequence numbers and broadcasts committed events in order
+type ChangeHub struct {
+	mu        sync.Mutex
+	next      uint64
+	committed uint64
+	trimmed   uint64 // events up to it are gone from the log
+	pending   map[uint64]*ChangeEvent
+	watchers  map[*watcher]bool
+}
+
+func (h *ChangeHub) Allocate() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.next++
+	return h.next
+}
+
+// ev is nil if the write failed, the seq is skipped
+func (h *ChangeHub) Commit(seq uint64, ev *ChangeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending[seq] = ev
+	for {
+		ev, ok := h.pending[h.committed+1]
+		if !ok {
+			break
+		}
+		delete(h.pending, h.committed+1)
+		h.committed++
+		if ev == nil {
+			continue
+		}
+		for w := range h.watchers {
+			if !strings.HasPrefix(ev.Key, w.prefix) {
+				continue
+			}
+			select {
+			case w.ch <- ev:
+			default:
+				// too slow, the client should resume from the last seq
+				Error("watcher on prefix %s lagged at seq:%d", w.prefix, ev.Seq)
+				close(w.ch)
+				delete(h.watchers, w)
+			}
+		}
+	}
+}
+
+// return the watcher and the seq it will receive events after
+func (h *ChangeHub) Subscribe(prefix string) (*watcher, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w := &watcher{prefix, make(chan *ChangeEvent, WATCHER_BUFFER)}
+	h.watchers[w] = true
+	return w, h.committed
+}
+
+func (h *ChangeHub) Unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		close(w.ch)
+		delete(h.watchers, w)
+	}
+}
+
+func (h *ChangeHub) Committed() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.committed
+}
+
+func (h *ChangeHub) Trimmed() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.trimmed
+}
+
+func (h *ChangeHub) setTrimmed(seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seq > h.trimmed {
+		h.trimmed = seq
+	}
+}
+
+func NewChangeHub(last uint64) *ChangeHub {
+	return &ChangeHub{
+		next:      last,
+		committed: last,
+		pending:   make(map[uint64]*ChangeEvent),
+		watchers:  make(map[*watcher]bool),
+	}
+}
+
+// return the largest seq of keys which are prefix followed by 8 bytes seq
+func (self *Leveldb) lastSeq(prefix []byte) uint64 {
+	end := append(append([]byte{}, prefix...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	it := self.NewIterator()
+	defer it.Close()
+	it.Seek(end)
+	if it.Valid() {
+		it.Prev()
+	} else {
+		it.SeekToLast()
+	}
+	if !it.Valid() || !bytes.HasPrefix(it.Key(), prefix) || len(it.Key()) != len(prefix)+8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(it.Key()[len(prefix):])
+}
+
+// seq of the last event trimmed from the change log, last if it's empty
+func (self *Leveldb) trimmedSeq(last uint64) uint64 {
+	it := self.NewIterator()
+	defer it.Close()
+	it.Seek(CHANGE_KEY_START)
+	if !it.Valid() || !bytes.HasPrefix(it.Key(), CHANGE_KEY_START) || len(it.Key()) != len(CHANGE_KEY_START)+8 {
+		return last
+	}
+	return binary.BigEndian.Uint64(it.Key()[len(CHANGE_KEY_START):]) - 1
+}
+
+// call cb on logged events in (from, to]
+func (self *Leveldb) ReadChanges(from, to uint64, cb func(ev *ChangeEvent) error) error {
+	it := self.NewIterator()
+	defer it.Close()
+
+	limit := changeKey(to)
+	for it.Seek(changeKey(from + 1)); it.Valid() && bytes.Compare(it.Key(), limit) <= 0; it.Next() {
+		var ev ChangeEvent
+		if err := json.Unmarshal(it.Value(), &ev); err != nil {
+			Error("unmarshal change event failed:%v", err)
+			continue
+		}
+		if err := cb(&ev); err != nil {
+			return err
+		}
+	}
+	return it.GetError()
+}
+
+// trim the change log to at most size events every minute
+func (self *Leveldb) trimChanges(size int) {
+	defer self.wg.Done()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.quit:
+			return
+		}
+		self.trimChangeLog(size)
+	}
+}
+
+// keep at most size events in the change log
+func (self *Leveldb) trimChangeLog(size int) {
+	committed := self.changes.Committed()
+	if committed <= uint64(size) {
+		return
+	}
+	trimmed := committed - uint64(size)
+	limit := changeKey(trimmed)
+	// watchers replaying from here on can't get these events any more
+	self.changes.setTrimmed(trimmed)
+	it := self.NewIterator()
+	batch := new(Batch)
+	for it.Seek(CHANGE_KEY_START); it.Valid() && bytes.Compare(it.Key(), limit) <= 0; it.Next() {
+		batch.Delete(it.Key())
+	}
+	it.Close()
+	if batch.Len() == 0 {
+		return
+	}
+	if err := self.Write(batch); err != nil {
+		Error("trim change log failed:%v", err)
+	} else {
+		Info("trim change log, %d events", batch.Len())
+	}
+}
+
+func (self *Leveldb) startChangeLog(config *LeveldbConfig) {
+	if config.ChangeLog <= 0 {
+		return
+	}
+	last := self.lastSeq(CHANGE_KEY_START)
+	self.changes = NewChangeHub(last)
+	self.changes.setTrimmed(self.trimmedSeq(last))
+	self.wg.Add(1)
+	go self.trimChanges(config.ChangeLog)
+	Info("change log enabled, last seq:%d", last)
+}
+
+type notification struct {
+	Jsonrpc string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+func pushNotification(sess *AgentSession, method string, params interface{}) bool {
+	body, err := json.Marshal(&notification{JSONRPC_VERSION, method, params})
+	if err != nil {
+		Error("marshal notification failed:%v", err)
+		return true
+	}
+	return sess.Push(body)
+}
+
+func (self *Leveldb) watch(sess *AgentSession, w *watcher, since, committed uint64) {
+	defer self.changes.Unsubscribe(w)
+
+	// replay the change log first
+	if since < committed {
+		err := self.ReadChanges(since, committed, func(ev *ChangeEvent) error {
+			if strings.HasPrefix(ev.Key, w.prefix) && !pushNotification(sess, "Change", ev) {
+				return AgentSessionClosed
+			}
+			return nil
+		})
+		if err != nil {
+			Error("replay change log from seq:%d failed:%v", since, err)
+			return
+		}
+		// trimmed while replaying, some events were skipped
+		if trimmed := self.changes.Trimmed(); since < trimmed {
+			pushNotification(sess, "WatchEnd", map[string]interface{}{"seq": since, "reason": "trimmed", "oldest": trimmed + 1})
+			return
+		}
+	}
+	last := committed
+	for {
+		select {
+		case ev, ok := <-w.ch:
+			if !ok {
+				pushNotification(sess, "WatchEnd", map[string]interface{}{"seq": last, "reason": "lagged"})
+				return
+			}
+			if !pushNotification(sess, "Change", ev) {
+				return
+			}
+			last = ev.Seq
+		case <-sess.Quit():
+			return
+		}
+	}
+}
+
+// params: {"prefix": prefix, "since": seq}, replay logged changes after since if given
+// result: {"seq": seq}, then Change notifications with ChangeEvent as params
+func handlerWatch(ud interface{}, params interface{}, sess *AgentSession) (result interface{}, err error) {
+	src := ud.(*Source)
+	db := src.db
+	if db.changes == nil {
+		err = errors.New("change log is disabled")
+		return
+	}
+	args, _ := params.(map[string]interface{})
+	prefix, _ := args["prefix"].(string)
+
+	w, committed := db.changes.Subscribe(prefix)
+	since := committed
+	if n, ok := args["since"].(float64); ok && n >= 0 && uint64(n) < committed {
+		since = uint64(n)
+	}
+	if trimmed := db.changes.Trimmed(); since < trimmed {
+		db.changes.Unsubscribe(w)
+		err = &AgentError{ERR_CHANGES_TRIMMED, fmt.Sprintf("changes after seq %d were trimmed, oldest seq:%d, resync and watch again", since, trimmed+1)}
+		return
+	}
+	Info("agent watch prefix:%s, since:%d", prefix, since)
+	go db.watch(sess, w, since, committed)
+	result = map[string]uint64{"seq": committed}
+	return
+}
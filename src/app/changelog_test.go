@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestSession(inflight int) *AgentSession {
+	return &AgentSession{pending: make(chan chan []byte, inflight), quit: make(chan bool), role: ROLE_ADMIN}
+}
+
+// next message pushed to sess
+func nextPush(t *testing.T, sess *AgentSession) (msg struct {
+	Method string
+	Params map[string]interface{}
+}) {
+	select {
+	case slot := <-sess.pending:
+		chunk := <-slot
+		if err := json.Unmarshal(chunk[4:], &msg); err != nil {
+			t.Fatalf("unmarshal push failed:%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("nothing pushed")
+	}
+	return
+}
+
+func putVersions(t *testing.T, db *Leveldb, n int) {
+	for i := 1; i <= n; i++ {
+		version := fmt.Sprint(i)
+		putFields(t, db, fmt.Sprintf("uid:%d", i), map[string]string{"version": version})
+	}
+}
+
+func TestWatchReplay(t *testing.T) {
+	db := newTestLeveldb(t, &LeveldbConfig{ChangeLog: 100})
+	putVersions(t, db, 3)
+	sess := newTestSession(16)
+	defer sess.close()
+
+	result, err := handlerWatch(&Source{db: db}, map[string]interface{}{"prefix": "uid:", "since": 1.0}, sess)
+	if err != nil {
+		t.Fatalf("watch failed:%v", err)
+	}
+	if seq := result.(map[string]uint64)["seq"]; seq != 3 {
+		t.Errorf("watch at seq %d, expect 3", seq)
+	}
+	for _, key := range []string{"uid:2", "uid:3"} {
+		if msg := nextPush(t, sess); msg.Method != "Change" || msg.Params["key"] != key {
+			t.Errorf("replayed %v, expect %s", msg, key)
+		}
+	}
+	putFields(t, db, "uid:4", map[string]string{"version": "4"})
+	putFields(t, db, "gid:1", map[string]string{"version": "1"})
+	putFields(t, db, "uid:5", map[string]string{"version": "5"})
+	for _, key := range []string{"uid:4", "uid:5"} {
+		if msg := nextPush(t, sess); msg.Method != "Change" || msg.Params["key"] != key {
+			t.Errorf("pushed %v, expect %s", msg, key)
+		}
+	}
+}
+
+func TestWatchTrimmed(t *testing.T) {
+	db := newTestLeveldb(t, &LeveldbConfig{ChangeLog: 100})
+	putVersions(t, db, 5)
+	db.trimChangeLog(2)
+	if n := countPrefix(db, CHANGE_KEY_START); n != 2 {
+		t.Fatalf("%d events left, expect 2", n)
+	}
+
+	src := &Source{db: db}
+	sess := newTestSession(16)
+	defer sess.close()
+	_, err := handlerWatch(src, map[string]interface{}{"since": 2.0}, sess)
+	if e, ok := err.(*AgentError); !ok || e.Code != ERR_CHANGES_TRIMMED {
+		t.Fatalf("expect trimmed error, got:%v", err)
+	}
+	if _, err = handlerWatch(src, map[string]interface{}{"since": 3.0}, sess); err != nil {
+		t.Fatalf("watch from the oldest event failed:%v", err)
+	}
+	for _, key := range []string{"uid:4", "uid:5"} {
+		if msg := nextPush(t, sess); msg.Params["key"] != key {
+			t.Errorf("replayed %v, expect %s", msg, key)
+		}
+	}
+}
+
+// the oldest logged event tells what was trimmed before a restart
+func TestChangeLogTrimmedSeq(t *testing.T) {
+	db := newTestLeveldb(t, &LeveldbConfig{ChangeLog: 100})
+	putVersions(t, db, 5)
+	db.trimChangeLog(2)
+	if seq := db.trimmedSeq(5); seq != 3 {
+		t.Errorf("trimmed seq %d, expect 3", seq)
+	}
+	if seq := newTestLeveldb(t, nil).trimmedSeq(0); seq != 0 {
+		t.Errorf("trimmed seq %d of an empty log", seq)
+	}
+}
+
+// a push waiting for a full connection must not keep the session from closing
+func TestPushDoesNotBlockClose(t *testing.T) {
+	sess := newTestSession(1)
+	if !sess.Push([]byte("{}")) {
+		t.Fatalf("push failed")
+	}
+	pushed := make(chan bool)
+	go func() {
+		pushed <- sess.Push([]byte("{}"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan bool)
+	go func() {
+		sess.Role()
+		sess.close()
+		close(closed)
+	}()
+	select {
+	case ok := <-pushed:
+		if ok {
+			t.Errorf("push succeeded on a closed session")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("push blocked")
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("close blocked")
+	}
+	if sess.Push([]byte("{}")) {
+		t.Errorf("push after close succeeded")
+	}
+}
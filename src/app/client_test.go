@@ -0,0 +1,405 @@
+package main
+
+import (
+	"agent"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listener which keeps accepted connections, so tests can drop them,
+// and holds them from the server while hold is locked
+type trackListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+	hold  sync.Mutex
+}
+
+func (l *trackListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	l.hold.Lock()
+	l.hold.Unlock()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, c)
+		l.mu.Unlock()
+	}
+	return c, err
+}
+
+func (l *trackListener) dropFirst() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns[0].Close()
+}
+
+func (l *trackListener) drop() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+	return len(l.conns)
+}
+
+func putFields(t *testing.T, db *Leveldb, key string, fields map[string]string) {
+	rec := &Record{Key: key, Type: "hash", Version: fields["version"], Fields: fields}
+	if err := db.PutRecord(rec); err != nil {
+		t.Fatalf("put key:%s failed:%v", key, err)
+	}
+}
+
+// run an agent with a default source and a "cache" source on temporary leveldbs
+// Slow calls running now and the most seen at once
+var slowRunning, slowMaxRunning int32
+
+func startTestAgent(t *testing.T) (*AgentSvr, *trackListener) {
+	if setting.Agent.MaxInflight <= 0 {
+		setting.Agent.MaxInflight = 64
+	}
+	if setting.Agent.MaxFrame <= 0 {
+		setting.Agent.MaxFrame = AGENT_MAX_FRAME
+	}
+	def := &Source{name: "default", db: newTestLeveldb(t, nil)}
+	putFields(t, def.db, "uid:1", map[string]string{"version": "1", "name": "a"})
+	putFields(t, def.db, "uid:2", map[string]string{"version": "2", "name": "b"})
+	putFields(t, def.db, "gid:1", map[string]string{"version": "1"})
+	cache := &Source{name: "cache", db: newTestLeveldb(t, nil)}
+	putFields(t, cache.db, "uid:1", map[string]string{"version": "3", "name": "c"})
+
+	svr := NewAgent([]*Source{def, cache})
+	svr.Register("Slow", nil, func(ud interface{}, params interface{}) (interface{}, error) {
+		n := atomic.AddInt32(&slowRunning, 1)
+		defer atomic.AddInt32(&slowRunning, -1)
+		for {
+			max := atomic.LoadInt32(&slowMaxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&slowMaxRunning, max, n) {
+				break
+			}
+		}
+		ms, _ := params.(float64)
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+		return "done", nil
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed:%v", err)
+	}
+	tl := &trackListener{Listener: ln}
+	go svr.Serve(tl)
+	t.Cleanup(svr.Stop)
+	return svr, tl
+}
+
+func TestClientGetAndMGet(t *testing.T) {
+	_, ln := startTestAgent(t)
+	c := agent.NewClient(ln.Addr().String(), agent.Options{PoolSize: 2})
+	defer c.Close()
+	ctx := context.Background()
+
+	data, err := c.Get(ctx, "uid:1")
+	if err != nil || data["name"] != "a" {
+		t.Errorf("get uid:1 failed:%v, %v", data, err)
+	}
+	data, err = c.Get(ctx, "uid:404")
+	if err != nil || data != nil {
+		t.Errorf("get missing key failed:%v, %v", data, err)
+	}
+
+	all, err := c.MGet(ctx, []string{"uid:1", "uid:2", "uid:404"})
+	if err != nil || len(all) != 3 || all["uid:2"]["name"] != "b" || all["uid:404"] != nil {
+		t.Errorf("mget failed:%v, %v", all, err)
+	}
+
+	keys, next, err := c.Scan(ctx, "uid:", "", 10)
+	if err != nil || len(keys) != 2 || next != "" {
+		t.Errorf("scan failed:%v, %s, %v", keys, next, err)
+	}
+	keys, next, err = c.Scan(ctx, "", "", 2)
+	if err != nil || len(keys) != 2 || next != "uid:2" {
+		t.Errorf("first page failed:%v, %s, %v", keys, next, err)
+	}
+	keys, next, err = c.Scan(ctx, "", next, 2)
+	if err != nil || len(keys) != 1 || keys[0] != "uid:2" || next != "" {
+		t.Errorf("last page failed:%v, %s, %v", keys, next, err)
+	}
+}
+
+func TestClientError(t *testing.T) {
+	_, ln := startTestAgent(t)
+	c := agent.NewClient(ln.Addr().String(), agent.Options{})
+	defer c.Close()
+	ctx := context.Background()
+
+	err := c.Call(ctx, "Unknown", nil, nil)
+	if e, ok := err.(*agent.Error); !ok || e.Code != ERR_METHOD_NOT_FOUND {
+		t.Errorf("expect unknown method error, got:%v", err)
+	}
+	err = c.Call(ctx, "Get", 1, nil)
+	if e, ok := err.(*agent.Error); !ok || e.Code != ERR_INVALID_PARAMS {
+		t.Errorf("expect invalid params error, got:%v", err)
+	}
+}
+
+func TestClientPipeline(t *testing.T) {
+	_, ln := startTestAgent(t)
+	c := agent.NewClient(ln.Addr().String(), agent.Options{PoolSize: 1})
+	defer c.Close()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(delay int) {
+			defer wg.Done()
+			var reply string
+			if err := c.Call(ctx, "Slow", delay, &reply); err != nil || reply != "done" {
+				t.Errorf("slow call failed:%s, %v", reply, err)
+			}
+		}(20 - i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := c.Get(ctx, "uid:2"); err != nil || data["name"] != "b" {
+				t.Errorf("pipelined get failed:%v, %v", data, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientTimeout(t *testing.T) {
+	_, ln := startTestAgent(t)
+	c := agent.NewClient(ln.Addr().String(), agent.Options{Timeout: 20 * time.Millisecond})
+	defer c.Close()
+
+	err := c.Call(context.Background(), "Slow", 200, nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expect timeout, got:%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = c.Call(ctx, "Slow", 50, nil); err != nil {
+		t.Errorf("ctx deadline should override timeout, got:%v", err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	_, ln := startTestAgent(t)
+	c := agent.NewClient(ln.Addr().String(), agent.Options{PoolSize: 1})
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "uid:1"); err != nil {
+		t.Fatalf("first get failed:%v", err)
+	}
+	if n := ln.drop(); n != 1 {
+		t.Fatalf("expect one connection, got %d", n)
+	}
+	// the first call may still go to the dropped connection
+	if _, err := c.Get(ctx, "uid:1"); err != nil {
+		Info("get on dropped connection:%v", err)
+	}
+	if data, err := c.Get(ctx, "uid:1"); err != nil || data["name"] != "a" {
+		t.Errorf("get after reconnect failed:%v, %v", data, err)
+	}
+	if n := ln.drop(); n != 2 {
+		t.Errorf("expect a new connection, got %d", n)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	old := setting.Auth
+	setting.Auth.Credentials = []Credential{{Name: "app", Token: "secret", Role: "read"}}
+	t.Cleanup(func() { setting.Auth = old })
+	_, ln := startTestAgent(t)
+	ctx := context.Background()
+
+	c := agent.NewClient(ln.Addr().String(), agent.Options{PoolSize: 1})
+	err := c.Call(ctx, "Get", "uid:1", nil)
+	if e, ok := err.(*agent.Error); !ok || e.Code != ERR_UNAUTHORIZED {
+		t.Errorf("expect auth required without token, got:%v", err)
+	}
+	c.Close()
+
+	c = agent.NewClient(ln.Addr().String(), agent.Options{PoolSize: 1, Token: "wrong"})
+	if _, err := c.Get(ctx, "uid:1"); err == nil {
+		t.Errorf("expect dial failure with wrong token")
+	}
+	c.Close()
+
+	c = agent.NewClient(ln.Addr().String(), agent.Options{PoolSize: 1, Token: "secret"})
+	defer c.Close()
+	if data, err := c.Get(ctx, "uid:1"); err != nil || data["name"] != "a" {
+		t.Errorf("get with token failed:%v, %v", data, err)
+	}
+	err = c.Call(ctx, "Load", "uid:1", nil)
+	if e, ok := err.(*agent.Error); !ok || e.Code != ERR_PERMISSION_DENIED {
+		t.Errorf("expect permission denied for read role, got:%v", err)
+	}
+}
+
+func TestClientSource(t *testing.T) {
+	_, ln := startTestAgent(t)
+	ctx := context.Background()
+
+	c := agent.NewClient(ln.Addr().String(), agent.Options{PoolSize: 1, Source: "cache"})
+	if data, err := c.Get(ctx, "uid:1"); err != nil || data["name"] != "c" {
+		t.Errorf("get from source failed:%v, %v", data, err)
+	}
+	c.Close()
+
+	c = agent.NewClient(ln.Addr().String(), agent.Options{PoolSize: 1, Source: "missing"})
+	defer c.Close()
+	err := c.Call(ctx, "Get", "uid:1", nil)
+	if e, ok := err.(*agent.Error); !ok || e.Code != ERR_METHOD_NOT_FOUND {
+		t.Errorf("expect error on unknown source, got:%v", err)
+	}
+}
+
+// a frame over the limit closes the connection before it's read
+func TestAgentFrameLimit(t *testing.T) {
+	old := setting.Agent.MaxFrame
+	setting.Agent.MaxFrame = 1024
+	t.Cleanup(func() { setting.Agent.MaxFrame = old })
+	_, ln := startTestAgent(t)
+
+	send := func(sz uint32) error {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial failed:%v", err)
+		}
+		defer conn.Close()
+		body := []byte(`{"id":1,"method":"Slow","params":0}`)
+		binary.Write(conn, binary.BigEndian, sz)
+		conn.Write(body)
+		conn.Write(make([]byte, int(sz)-len(body)))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var n uint32
+		return binary.Read(conn, binary.BigEndian, &n)
+	}
+	if err := send(1024); err != nil {
+		t.Errorf("frame at the limit failed:%v", err)
+	}
+	if err := send(1025); err == nil {
+		t.Errorf("frame over the limit answered")
+	}
+}
+
+func TestAgentFrameLimitBeforeAuth(t *testing.T) {
+	old := setting.Auth
+	setting.Auth.Credentials = []Credential{{Name: "app", Token: "secret", Role: "read"}}
+	t.Cleanup(func() { setting.Auth = old })
+	_, ln := startTestAgent(t)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed:%v", err)
+	}
+	defer conn.Close()
+	binary.Write(conn, binary.BigEndian, uint32(AGENT_NOAUTH_MAX_FRAME+1))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var n uint32
+	if err = binary.Read(conn, binary.BigEndian, &n); err == nil {
+		t.Errorf("big frame accepted before auth")
+	}
+}
+
+// a redial waiting for Auth doesn't hold up calls on healthy connections
+func TestClientSlowRedial(t *testing.T) {
+	old := setting.Auth
+	setting.Auth.Credentials = []Credential{{Name: "app", Token: "secret", Role: "read"}}
+	t.Cleanup(func() { setting.Auth = old })
+	_, ln := startTestAgent(t)
+	ctx := context.Background()
+
+	c := agent.NewClient(ln.Addr().String(), agent.Options{PoolSize: 2, Token: "secret"})
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(ctx, "uid:1"); err != nil {
+			t.Fatalf("get failed:%v", err)
+		}
+	}
+	// break the first connection, its redial can't authenticate until released
+	ln.dropFirst()
+	time.Sleep(50 * time.Millisecond)
+	ln.hold.Lock()
+	redialed := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		_, err := c.Get(ctx, "uid:1")
+		redialed <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := c.Get(ctx, "uid:1"); err != nil {
+		t.Errorf("get on the healthy connection failed:%v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("get on the healthy connection took %v", d)
+	}
+	ln.hold.Unlock()
+	if err := <-redialed; err != nil {
+		t.Errorf("get after redial failed:%v", err)
+	}
+}
+
+func TestClientMaxFrame(t *testing.T) {
+	_, ln := startTestAgent(t)
+	c := agent.NewClient(ln.Addr().String(), agent.Options{PoolSize: 1, MaxFrame: 16})
+	defer c.Close()
+	if _, err := c.Get(context.Background(), "uid:1"); err == nil {
+		t.Errorf("response over the limit accepted")
+	}
+}
+
+func TestAgentResponseOrder(t *testing.T) {
+	old := setting.Agent.MaxInflight
+	setting.Agent.MaxInflight = 4
+	t.Cleanup(func() { setting.Agent.MaxInflight = old })
+	atomic.StoreInt32(&slowMaxRunning, 0)
+	_, ln := startTestAgent(t)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed:%v", err)
+	}
+	defer conn.Close()
+	// later requests finish first, replies must still come in request order
+	const n = 12
+	for i := 1; i <= n; i++ {
+		body, _ := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0", "id": i, "method": "Slow", "params": (n - i) * 10,
+		})
+		binary.Write(conn, binary.BigEndian, uint32(len(body)))
+		conn.Write(body)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 1; i <= n; i++ {
+		var sz uint32
+		if err = binary.Read(conn, binary.BigEndian, &sz); err != nil {
+			t.Fatalf("read reply %d failed:%v", i, err)
+		}
+		buf := make([]byte, sz)
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("read reply %d failed:%v", i, err)
+		}
+		var resp struct{ Id int }
+		if err = json.Unmarshal(buf, &resp); err != nil || resp.Id != i {
+			t.Fatalf("reply %d got id %d, %v: %s", i, resp.Id, err, buf)
+		}
+	}
+	if max := atomic.LoadInt32(&slowMaxRunning); max > 4 || max < 2 {
+		t.Errorf("%d requests ran at once, want 2..4", max)
+	}
+}
@@ -15,6 +15,7 @@ type CmdService struct {
 	ln       net.Listener
 	addr     string
 	handlers map[string][]interface{}
+	sources  map[string]interface{} // ud of commands on each source
 	wg       sync.WaitGroup
 }
 
@@ -28,6 +29,8 @@ func (c *CmdService) handleConnection(conn net.Conn) {
 	}()
 
 	Info("handle conn:%v", conn)
+	role := defaultRole()
+	var source interface{} // nil for the default source
 	reader := bufio.NewReader(conn)
 	for {
 		s, err := reader.ReadString('\n')
@@ -46,9 +49,22 @@ func (c *CmdService) handleConnection(conn net.Conn) {
 		from := time.Now()
 		cmd := args[0]
 		cb, ok := c.handlers[cmd]
-		if ok {
+		if cmd == "auth" {
+			// the token must not be logged
+			response = c.auth(conn, args[1:], &role)
+		} else if (ok || cmd == "source") && role == ROLE_NONE {
+			response = "- " + AuthRequired.Error()
+		} else if cmd == "source" {
+			response = c.selectSource(args[1:], &source)
+		} else if ok && role < requiredRole(commandRoles, cmd) {
+			Error("conn:%v denied command:%s", conn.RemoteAddr(), cmd)
+			response = "- " + PermissionDenied.Error()
+		} else if ok {
 			Info("recv command: %s", cmd)
 			ud := cb[0]
+			if source != nil {
+				ud = source
+			}
 			handle := cb[1].(CmdHandler)
 			result, err := handle(ud, args[1:])
 			if err != nil {
@@ -66,6 +82,41 @@ func (c *CmdService) handleConnection(conn net.Conn) {
 	Info("end handle conn:%v", conn)
 }
 
+func (c *CmdService) auth(conn net.Conn, args []string, role *int) string {
+	if len(args) != 1 {
+		return "- auth <token>"
+	}
+	if !authEnabled() {
+		return "+ auth is disabled"
+	}
+	name, r, err := authenticate(args[0])
+	if err != nil {
+		Error("conn:%v auth failed", conn.RemoteAddr())
+		*role = ROLE_NONE
+		return "- " + err.Error()
+	}
+	Info("conn:%v auth as %s(%s)", conn.RemoteAddr(), name, roleNames[r])
+	*role = r
+	return "+ " + roleNames[r]
+}
+
+// source <name>, later commands on the connection work on the source
+func (c *CmdService) selectSource(args []string, source *interface{}) string {
+	if len(args) != 1 {
+		return "- source <name>"
+	}
+	ud, ok := c.sources[args[0]]
+	if !ok {
+		return "- unknown source: " + args[0]
+	}
+	*source = ud
+	return "+ " + args[0]
+}
+
+func (c *CmdService) RegisterSource(name string, ud interface{}) {
+	c.sources[name] = ud
+}
+
 func (c *CmdService) Register(cmd string, ud interface{}, handler CmdHandler) {
 	_, ok := c.handlers[cmd]
 	if handler == nil && ok {
@@ -81,7 +132,7 @@ func (c *CmdService) Start() {
 	c.wg.Add(1)
 	defer c.wg.Done()
 
-	ln, err := net.Listen("tcp", c.addr)
+	ln, err := listen(c.addr, &setting.Manager.Tls)
 	if err != nil {
 		Panic("start manager failed:%v", err)
 	}
@@ -116,5 +167,6 @@ func NewCmdService() *CmdService {
 	cmdService := new(CmdService)
 	cmdService.addr = setting.Manager.Addr
 	cmdService.handlers = make(map[string][]interface{})
+	cmdService.sources = make(map[string]interface{})
 	return cmdService
 }
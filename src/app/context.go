@@ -2,9 +2,9 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"levigo"
 	"redis"
 	"reflect"
 	"runtime"
@@ -69,22 +69,93 @@ func info(ud interface{}, args []string) (result string, err error) {
 	return
 }
 
+// records from key start to key limit, the first or last record if empty
+func dataRange(start, limit string) levigo.Range {
+	r := levigo.Range{Start: DATA_KEY_START, Limit: DATA_KEY_LIMIT}
+	if start != "" {
+		r.Start = dataKey(start)
+	}
+	if limit != "" {
+		r.Limit = dataKey(limit)
+	}
+	return r
+}
+
+// compact [start] [limit], keys of records, everything if no range is given
+func compact(ud interface{}, args []string) (result string, err error) {
+	context := ud.(*Context)
+	db := context.db
+
+	var start, limit string
+	if len(args) > 0 {
+		start = args[0]
+	}
+	if len(args) > 1 {
+		limit = args[1]
+	}
+	Info("compact range:[%s, %s)", start, limit)
+	if len(args) == 0 {
+		db.Compact(nil, nil)
+	} else {
+		r := dataRange(start, limit)
+		db.Compact(r.Start, r.Limit)
+	}
+	result = fmt.Sprintf("compact range:[%s, %s) finish", start, limit)
+	return
+}
+
+var leveldbRangeNames = []string{"data", "index", "all"}
+var leveldbRanges = []levigo.Range{
+	{Start: DATA_KEY_START, Limit: DATA_KEY_LIMIT},
+	{Start: INDEX_KEY_START, Limit: INDEX_KEY_END},
+	{Start: []byte{0}, Limit: []byte{0xff}},
+}
+
+// sizes [start limit], keys of records
+func sizes(ud interface{}, args []string) (result string, err error) {
+	context := ud.(*Context)
+	db := context.db
+
+	names := leveldbRangeNames
+	ranges := leveldbRanges
+	if len(args) > 1 {
+		names = []string{args[0] + " - " + args[1]}
+		ranges = []levigo.Range{dataRange(args[0], args[1])}
+	}
+
+	buf := bytes.NewBufferString("approximate sizes:\n")
+	for i, size := range db.Sizes(ranges) {
+		fmt.Fprintf(buf, "%s: %d\n", names[i], size)
+	}
+	result = buf.String()
+	return
+}
+
+// sync <key> [force], force overwrites a newer version in leveldb
 func sync_one(ud interface{}, args []string) (result string, err error) {
 	context := ud.(*Context)
 	sync_queue := context.sync_queue
 
-	key := ""
-	if len(args) > 0 {
-		key = args[0]
+	if len(args) == 0 || args[0] == "" {
+		err = errors.New("no key")
+		return
+	}
+	force := false
+	if len(args) > 1 {
+		if args[1] != "force" {
+			err = fmt.Errorf("unknown option %s", args[1])
+			return
+		}
+		force = true
 	}
-	sync_queue <- key
+	sync_queue <- &SyncTask{Key: args[0], Force: force}
 	return
 }
 
 func sync_all(ud interface{}, args []string) (result string, err error) {
 	context := ud.(*Context)
 	sync_queue := context.sync_queue
-	cli, err := GetRedisConnection()
+	cli, err := context.config.Connect()
 	if err != nil {
 		return
 	}
@@ -95,12 +166,12 @@ func sync_all(ud interface{}, args []string) (result string, err error) {
 		Error("sync_all cmd service failed:%v", err)
 		return
 	}
-	keys := all_key_strings.([]string)
+	keys := persistableKeys(all_key_strings.([]string))
 	sort.Strings(keys)
 	sz := len(keys)
 	cur := 0
 	for _, key := range keys {
-		sync_queue <- key
+		sync_queue <- &SyncTask{Key: key}
 		cur += 1
 		if cur%100 == 0 {
 			Info("sync progress: %d/%d, queue:%d", cur, sz, len(sync_queue))
@@ -127,7 +198,7 @@ func count(ud interface{}, args []string) (result string, err error) {
 
 func check(ud interface{}, args []string) (result string, err error) {
 	context := ud.(*Context)
-	cli, err := GetRedisConnection()
+	cli, err := context.config.Connect()
 	if err != nil {
 		return
 	}
@@ -152,7 +223,7 @@ func check(ud interface{}, args []string) (result string, err error) {
 	if err != nil {
 		return
 	}
-	keys := ret.([]string)
+	keys := persistableKeys(ret.([]string))
 	sort.Strings(keys)
 	total := len(keys)
 
@@ -163,25 +234,19 @@ func check(ud interface{}, args []string) (result string, err error) {
 			Error("hgetall key %s failed:%v", key, err)
 			return
 		}
-		var chunk []byte
-		var leveldb_data map[string]string
-		if chunk, err = db.Get([]byte(key)); err != nil {
+		var rec *Record
+		if rec, err = db.GetRecord(key); err != nil {
 			Error("leveldb.Get failed on key %s failed:%v", key, err)
 			return
 		}
-		if chunk == nil {
+		if rec == nil {
 			if miss != nil {
 				miss = append(miss, key)
 			}
 			miss_count++
 			continue
 		}
-		err = json.Unmarshal(chunk, &leveldb_data)
-		if err != nil {
-			Error("json.Unmarshal failed on key %s failed:%v", key, err)
-			continue
-		}
-		if !reflect.DeepEqual(redis_data, leveldb_data) {
+		if !reflect.DeepEqual(fieldRulesOf(key).Persisted(redis_data), rec.Fields) {
 			if mismatch != nil {
 				mismatch = append(mismatch, key)
 			}
@@ -214,7 +279,7 @@ func check(ud interface{}, args []string) (result string, err error) {
 
 func fast_check(ud interface{}, args []string) (result string, err error) {
 	context := ud.(*Context)
-	cli, err := GetRedisConnection()
+	cli, err := context.config.Connect()
 	if err != nil {
 		return
 	}
@@ -239,13 +304,13 @@ func fast_check(ud interface{}, args []string) (result string, err error) {
 	if err != nil {
 		return
 	}
-	keys := ret.([]string)
+	keys := persistableKeys(ret.([]string))
 	total := len(keys)
 
 	var cur_version string // redis
 	var bak_version []byte // leveldb
 	for i, key := range keys {
-		if ret, err = cli.Hget(key, "version"); err != nil {
+		if ret, err = cli.Hget(key, setting.Version.Field); err != nil {
 			return
 		}
 		cur_version = ret.(string)
@@ -299,109 +364,195 @@ func dump(ud interface{}, args []string) (result string, err error) {
 	context := ud.(*Context)
 	db := context.db
 
-	chunk, err := db.Get([]byte(key))
-	if chunk == nil || err != nil {
+	rec, err := db.GetRecord(key)
+	if rec == nil || err != nil {
 		Error("fetch data failed:%v", err)
 		return
 	}
 
-	Info("dump key:%s(%d)", key, len(chunk))
-	var data map[string]string
-	err = json.Unmarshal(chunk, &data)
-	if err != nil {
-		Error("unmarshal chunk failed:%v", err)
-		return
-	}
-
+	Info("dump key:%s(%d)", key, len(rec.Fields))
 	buf := bytes.NewBufferString("content:\n")
-	for key, val := range data {
+	for key, val := range rec.Fields {
 		fmt.Fprintf(buf, "%v:\t%v\n", key, val)
 	}
+	fmt.Fprintf(buf, "ttl: %s\n", formatTtl(rec.Ttl()))
 	result = buf.String()
 	return
 }
 
-func restore(ud interface{}, key string, cli *redis.Redis) (err error) {
+func persistableKeys(keys []string) []string {
+	found := keys[:0]
+	for _, key := range keys {
+		if persistable(key) {
+			found = append(found, key)
+		}
+	}
+	return found
+}
+
+// restore key from leveldb into the target of opts, which cli connects to
+func restore(ud interface{}, key string, cli *redis.Redis, opts *RestoreOptions) (err error) {
 	context := ud.(*Context)
 	db := context.db
-	var chunk []byte
-	if chunk, err = db.Get([]byte(key)); err != nil {
+	var rec *Record
+	if rec, err = db.GetRecord(key); err != nil {
 		Error("query key %s failed:%v", key, err)
 		return
 	}
 
-	if chunk == nil {
+	if rec == nil {
 		err = errors.New("key doesn't exist on leveldb")
 		return
 	}
-
-	var leveldb_data map[string]string
-	err = json.Unmarshal(chunk, &leveldb_data)
-	if err != nil {
+	ttl := rec.Ttl()
+	if ttl == 0 {
+		Info("skip expired key %s, expired at:%d", key, rec.ExpireAt)
+		err = RecordExpired
 		return
 	}
+
+	target := opts.TargetKey(key)
+	leveldb_data := rec.Fields
 	redis_data := make(map[string]string)
-	err = cli.Hgetall(key, redis_data)
+	err = cli.Hgetall(target, redis_data)
 	if err != nil {
-		Error("hgetall key %s failed:%v", key, err)
+		Error("hgetall key %s failed:%v", target, err)
+		return
+	}
+
+	// compare in the persisted form, and keep what leveldb can't restore
+	rules := fieldRulesOf(key)
+	data := db.conflicts.resolve(opts.Policy, rules.Persisted(redis_data), leveldb_data)
+	if data == nil {
+		Info("keep key %s in redis, version:%s, leveldb version:%s, policy:%s",
+			target, versionOf(redis_data), versionOf(leveldb_data), opts.Policy)
+		return
+	}
+	data = rules.Restored(data)
+	for k, v := range rules.Untracked(redis_data) {
+		data[k] = v
+	}
+	if len(data) == 0 {
+		Info("nothing of key %s can be restored", key)
+		return
+	}
+	if err = replaceHash(cli, target, data, ttl); err != nil {
+		Error("replace key %s failed:%v", target, err)
+		return
+	}
+	return
+}
+
+// flatten fields as hmset arguments after heads
+func hashArgs(fields map[string]string, heads ...interface{}) []interface{} {
+	args := make([]interface{}, len(heads), len(fields)*2+len(heads))
+	copy(args, heads)
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	return args
+}
+
+// like restore, but never touch a key which already exists in redis
+func load(db *Leveldb, key string, ttl int, cli *redis.Redis) (loaded bool, err error) {
+	var rec *Record
+	if rec, err = db.GetRecord(key); err != nil {
+		Error("query key %s failed:%v", key, err)
 		return
 	}
 
-	if redis_data["version"] >= leveldb_data["version"] && len(redis_data) > 0 {
-		Info("redis_data[version]:%s >= leveldb_data[version]:%s", redis_data["version"], leveldb_data["version"])
+	if rec == nil || rec.Ttl() == 0 {
 		return
 	}
-	leveldb_array := make([]interface{}, len(leveldb_data)*2+1)
-	leveldb_array[0] = key
-	i := 1
-	for k, v := range leveldb_data {
-		leveldb_array[i] = k
-		leveldb_array[i+1] = v
-		i = i + 2
+	fields := fieldRulesOf(key).Restored(rec.Fields)
+	if len(fields) == 0 {
+		return
 	}
-	_, err = cli.Exec("hmset", leveldb_array...)
+
+	// the persisted ttl caps the load ttl
+	pttl := int64(0)
+	if ns := namespaceOf(key); ns == nil || ns.AllowsLoadTtl() {
+		pttl = int64(ttl) * 1000
+	}
+	if remain := rec.Ttl(); remain > 0 && (pttl <= 0 || remain < pttl) {
+		pttl = remain
+	}
+	ret, err := cli.Exec("eval", hashArgs(fields, LOAD_SCRIPT, 1, key, int(pttl))...)
 	if err != nil {
-		Error("hmset key %s failed:%v", key, err)
+		Error("load key %s failed:%v", key, err)
 		return
 	}
+	loaded = ret.(int) == 1
 	return
 }
 
+// restore_one key [policy] [options], see parseRestoreOptions
 func restore_one(ud interface{}, args []string) (result string, err error) {
 	if len(args) < 1 {
 		err = errors.New("restore need one argument")
 		return
 	}
 	key := args[0]
-	cli, err := GetRedisConnection()
+	context := ud.(*Context)
+	opts, err := parseRestoreOptions(context.config, args[1:])
+	if err != nil {
+		return
+	}
+	if !opts.Match(key) {
+		err = fmt.Errorf("key doesn't match from:%s, ns:%s", opts.From, opts.Namespace)
+		return
+	}
+	cli, err := opts.Connect()
 	if err != nil {
 		return
 	}
 	defer cli.Close()
 
-	err = restore(ud, key, cli)
+	err = restore(ud, key, cli, opts)
+	if err == RecordExpired {
+		result = fmt.Sprintf("skip expired key:%s", key)
+		err = nil
+		return
+	}
 	if err != nil {
 		return
 	}
-	result = fmt.Sprintf("set key:%s", key)
+	result = fmt.Sprintf("set key:%s", opts.TargetKey(key))
 	return
 }
 
+// restore_all [policy] [options], see parseRestoreOptions
 func restore_all(ud interface{}, args []string) (result string, err error) {
 	context := ud.(*Context)
+	opts, err := parseRestoreOptions(context.config, args)
+	if err != nil {
+		return
+	}
 	db := context.db
 	it := db.NewIterator()
+	defer it.Close()
 	count := 0
 	restore_count := 0
-	cli, err := GetRedisConnection()
+	expired_count := 0
+	cli, err := opts.Connect()
 	if err != nil {
 		return
 	}
 	defer cli.Close()
 
-	for it.Seek(KEY_START); it.Valid() && bytes.Compare(it.Key(), KEY_END) <= 0; it.Next() {
-		err = restore(ud, string(it.Key()), cli)
-		if err != nil {
+	Info("restore all into %s", opts)
+	limiter := newRateLimiter(opts.Rate)
+	start := dataKey(opts.From)
+	for it.Seek(start); it.Valid() && bytes.HasPrefix(it.Key(), start); it.Next() {
+		key := string(it.Key()[len(DATA_PREFIX):])
+		if !opts.Match(key) {
+			continue
+		}
+		limiter.Wait()
+		err = restore(ud, key, cli, opts)
+		if err == RecordExpired {
+			expired_count++
+		} else if err != nil {
 			return
 		} else {
 			restore_count++
@@ -411,7 +562,8 @@ func restore_all(ud interface{}, args []string) (result string, err error) {
 			Info("progress:%d, restore:%d", count, restore_count)
 		}
 	}
-	result = fmt.Sprintf("restore key %d, total %d\n", restore_count, count)
+	err = nil
+	result = fmt.Sprintf("restore key %d, expired %d, total %d\n", restore_count, expired_count, count)
 	return
 }
 
@@ -449,20 +601,21 @@ func keys(ud interface{}, args []string) (result string, err error) {
 	return
 }
 
-func diff(ud interface{}, args []string) (result string, err error) {
-	if len(args) == 0 {
-		err = errors.New("no key")
-		return
-	}
+type KeyDiff struct {
+	Key         string               `json:"key"`
+	Mismatch    map[string][2]string `json:"mismatch"` // field: [redis, leveldb]
+	OnlyRedis   []string             `json:"only_redis"`
+	OnlyLeveldb []string             `json:"only_leveldb"`
+	RedisTtl    int64                `json:"redis_ttl"`   // ms, -1 if no ttl, -2 if missing
+	LeveldbTtl  int64                `json:"leveldb_ttl"` // ms, -1 if no ttl, 0 if expired
+}
 
-	key := args[0]
-	context := ud.(*Context)
-	cli, err := GetRedisConnection()
-	if err != nil {
-		return
-	}
-	defer cli.Close()
-	db := context.db
+func (d *KeyDiff) Match() bool {
+	return len(d.Mismatch) == 0 && len(d.OnlyRedis) == 0 && len(d.OnlyLeveldb) == 0
+}
+
+// return nil if key doesn't exist on leveldb
+func diffKey(db *Leveldb, cli *redis.Redis, key string) (d *KeyDiff, err error) {
 	// query redis
 	left := make(map[string]string)
 	err = cli.Hgetall(key, left)
@@ -470,38 +623,80 @@ func diff(ud interface{}, args []string) (result string, err error) {
 		return
 	}
 
-	chunk, err := db.Get([]byte(key))
-	if chunk == nil || err != nil {
+	rec, err := db.GetRecord(key)
+	if rec == nil || err != nil {
 		Error("fetch data from leveldb failed:%v", err)
 		return
 	}
 
-	var right map[string]string
-	err = json.Unmarshal(chunk, &right)
+	ret, err := cli.Exec("pttl", key)
 	if err != nil {
-		Error("unmarshal chunk failed:%v", err)
 		return
 	}
+	redis_ttl, _ := ret.(int)
 
-	buf := bytes.NewBufferString("left:redis, right:leveldb\n")
-	buf_len := buf.Len()
+	// compare in the persisted form
+	left = fieldRulesOf(key).Persisted(left)
+	right := rec.Fields
+	d = &KeyDiff{
+		Key:         key,
+		Mismatch:    make(map[string][2]string),
+		OnlyRedis:   make([]string, 0),
+		OnlyLeveldb: make([]string, 0),
+		RedisTtl:    int64(redis_ttl),
+		LeveldbTtl:  rec.Ttl(),
+	}
 	for k, v1 := range left {
 		if v2, ok := right[k]; ok {
 			if v1 != v2 {
-				fmt.Fprintf(buf, "%s < %s, %s\n", k, v1, v2)
+				d.Mismatch[k] = [2]string{v1, v2}
 			}
 		} else {
-			fmt.Fprintf(buf, "%s, only in left\n", k)
+			d.OnlyRedis = append(d.OnlyRedis, k)
 		}
 	}
 
 	for k, _ := range right {
 		if _, ok := left[k]; !ok {
-			fmt.Fprintf(buf, "%s, only in right\n", k)
+			d.OnlyLeveldb = append(d.OnlyLeveldb, k)
 		}
 	}
+	return
+}
 
-	if buf_len == buf.Len() {
+func diff(ud interface{}, args []string) (result string, err error) {
+	if len(args) == 0 {
+		err = errors.New("no key")
+		return
+	}
+
+	key := args[0]
+	context := ud.(*Context)
+	cli, err := context.config.Connect()
+	if err != nil {
+		return
+	}
+	defer cli.Close()
+
+	d, err := diffKey(context.db, cli, key)
+	if d == nil || err != nil {
+		return
+	}
+
+	buf := bytes.NewBufferString("left:redis, right:leveldb\n")
+	for k, v := range d.Mismatch {
+		fmt.Fprintf(buf, "%s < %s, %s\n", k, v[0], v[1])
+	}
+	for _, k := range d.OnlyRedis {
+		fmt.Fprintf(buf, "%s, only in left\n", k)
+	}
+	for _, k := range d.OnlyLeveldb {
+		fmt.Fprintf(buf, "%s, only in right\n", k)
+	}
+
+	fmt.Fprintf(buf, "ttl < %s, %s\n", formatTtl(d.RedisTtl), formatTtl(d.LeveldbTtl))
+
+	if d.Match() {
 		fmt.Fprintf(buf, "perfect match\n")
 	}
 
@@ -514,6 +709,9 @@ func (context *Context) Register(c *CmdService) {
 	c.Register("help", context, help)
 	c.Register("procs", context, procs)
 	c.Register("info", context, info)
+	c.Register("compact", context, compact)
+	c.Register("sizes", context, sizes)
+	c.Register("durability", context, durability)
 	c.Register("sync", context, sync_one)
 	c.Register("sync_all", context, sync_all)
 	c.Register("dump", context, dump)
@@ -525,12 +723,16 @@ func (context *Context) Register(c *CmdService) {
 	c.Register("fast_check", context, fast_check)
 	c.Register("restore_one", context, restore_one)
 	c.Register("restore_all", context, restore_all)
-}
-
-func GetRedisConnection() (cli *redis.Redis, err error) {
-	cli = redis.NewRedis(setting.Redis.Host, setting.Redis.Password, setting.Redis.Db)
-	err = cli.Connect()
-	return
+	c.Register("export", context, export)
+	c.Register("import", context, import_)
+	c.Register("migrate", context, migrate)
+	c.Register("find", context, find)
+	c.Register("reindex", context, reindex)
+	c.Register("sinks", context, sinks)
+	c.Register("evict", context, evict)
+	c.Register("conflicts", context, conflicts)
+	c.Register("namespaces", context, namespaces)
+	c.Register("sources", context, sources)
 }
 
 func NewContext() *Context {
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCompactAndSizesUseRecordKeys(t *testing.T) {
+	db := newTestLeveldb(t, nil)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("uid:%02d", i)
+		rec := &Record{Key: key, Version: "1", Fields: map[string]string{"version": "1", "name": strings.Repeat("x", 100)}}
+		if err := db.PutRecord(rec); err != nil {
+			t.Fatalf("put record failed:%v", err)
+		}
+	}
+	context := &Context{Source: &Source{db: db}}
+	if _, err := compact(context, []string{"uid:00", "uid:99"}); err != nil {
+		t.Fatalf("compact failed:%v", err)
+	}
+
+	size := func(start, limit string) (n uint64) {
+		result, err := sizes(context, []string{start, limit})
+		if err != nil {
+			t.Fatalf("sizes failed:%v", err)
+		}
+		fmt.Sscanf(result, "approximate sizes:\n"+start+" - "+limit+": %d", &n)
+		return
+	}
+	if n := size("uid:00", "uid:99"); n == 0 {
+		t.Errorf("no size of the records")
+	}
+	if n := size("gid:00", "gid:99"); n != 0 {
+		t.Errorf("size %d of missing keys", n)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"levigo"
+	"sync"
+	"time"
+)
+
+const (
+	DURABILITY_NONE     = "none"
+	DURABILITY_PERIODIC = "periodic"
+	DURABILITY_SYNC     = "sync"
+)
+
+const MAX_GROUP_COMMIT int = 256
+
+type batchOp struct {
+	key   []byte
+	value []byte
+	del   bool
+}
+
+// Batch collects writes which must be applied atomically
+type Batch struct {
+	ops []batchOp
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key, value, false})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key, nil, true})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) fill(wb *levigo.WriteBatch) {
+	for _, op := range b.ops {
+		if op.del {
+			wb.Delete(op.key)
+		} else {
+			wb.Put(op.key, op.value)
+		}
+	}
+}
+
+type commitReq struct {
+	batch *Batch
+	done  chan error
+}
+
+type SyncStats struct {
+	mu      sync.Mutex
+	count   int64
+	total   time.Duration
+	max     time.Duration
+	last    time.Duration
+	groups  int64
+	batches int64
+}
+
+func (s *SyncStats) add(elapsed time.Duration, batches int) {
+	s.mu.Lock()
+	s.count++
+	s.total += elapsed
+	s.last = elapsed
+	if elapsed > s.max {
+		s.max = elapsed
+	}
+	if batches > 0 {
+		s.groups++
+		s.batches += int64(batches)
+	}
+	s.mu.Unlock()
+}
+
+type SyncSnapshot struct {
+	Count     int64   `json:"fsync_count"`
+	Avg       float64 `json:"fsync_avg_ms"`
+	Max       float64 `json:"fsync_max_ms"`
+	Last      float64 `json:"fsync_last_ms"`
+	Groups    int64   `json:"group_commits"`
+	GroupSize float64 `json:"avg_group_size"`
+}
+
+func ms(d time.Duration) float64 {
+	return d.Seconds() * 1000
+}
+
+func (s *SyncStats) Snapshot() *SyncSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := &SyncSnapshot{
+		Count:  s.count,
+		Max:    ms(s.max),
+		Last:   ms(s.last),
+		Groups: s.groups,
+	}
+	if s.count > 0 {
+		snap.Avg = ms(s.total / time.Duration(s.count))
+	}
+	if s.groups > 0 {
+		snap.GroupSize = float64(s.batches) / float64(s.groups)
+	}
+	return snap
+}
+
+func (s *SyncStats) String() string {
+	snap := s.Snapshot()
+	return fmt.Sprintf("fsync count:%d\nfsync avg:%.3fms\nfsync max:%.3fms\nfsync last:%.3fms\ngroup commits:%d\navg group size:%.2f\n",
+		snap.Count, snap.Avg, snap.Max, snap.Last, snap.Groups, snap.GroupSize)
+}
+
+func (self *Leveldb) Write(batch *Batch) error {
+	if self.durability == DURABILITY_SYNC {
+		req := &commitReq{batch, make(chan error, 1)}
+		self.commits <- req
+		return <-req.done
+	}
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	batch.fill(wb)
+	return self.db.Write(self.woptions, wb)
+}
+
+// merge concurrent batches into one synced write
+func (self *Leveldb) groupCommit() {
+	defer self.wg.Done()
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	reqs := make([]*commitReq, 0, MAX_GROUP_COMMIT)
+	for req := range self.commits {
+		reqs = append(reqs[:0], req)
+	drain:
+		for len(reqs) < MAX_GROUP_COMMIT {
+			select {
+			case req, ok := <-self.commits:
+				if !ok {
+					break drain
+				}
+				reqs = append(reqs, req)
+			default:
+				break drain
+			}
+		}
+
+		wb.Clear()
+		for _, req := range reqs {
+			req.batch.fill(wb)
+		}
+		from := time.Now()
+		err := self.syncWrite(wb)
+		self.syncStats.add(time.Now().Sub(from), len(reqs))
+		if err != nil {
+			Error("group commit %d batches failed:%v", len(reqs), err)
+		}
+		for _, req := range reqs {
+			req.done <- err
+		}
+	}
+}
+
+// an empty synced write flushes the log written by unsynced writes
+func (self *Leveldb) periodicSync(interval time.Duration) {
+	defer self.wg.Done()
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			from := time.Now()
+			if err := self.syncWrite(wb); err != nil {
+				Error("periodic sync failed:%v", err)
+			}
+			self.syncStats.add(time.Now().Sub(from), 0)
+		case <-self.quit:
+			return
+		}
+	}
+}
+
+func (self *Leveldb) writeSynced(wb *levigo.WriteBatch) error {
+	return self.db.Write(self.syncWoptions, wb)
+}
+
+func (self *Leveldb) startDurability(config *LeveldbConfig) {
+	self.durability = config.Durability
+	self.syncWrite = self.writeSynced
+	self.quit = make(chan bool)
+	switch self.durability {
+	case DURABILITY_SYNC:
+		self.commits = make(chan *commitReq, MAX_GROUP_COMMIT)
+		self.wg.Add(1)
+		go self.groupCommit()
+	case DURABILITY_PERIODIC:
+		self.wg.Add(1)
+		go self.periodicSync(time.Duration(config.SyncInterval) * time.Millisecond)
+	case DURABILITY_NONE:
+	default:
+		Panic("unknown durability:%s", self.durability)
+	}
+	Info("leveldb durability:%s", self.durability)
+}
+
+func (self *Leveldb) stopDurability() {
+	if self.quit == nil {
+		return
+	}
+	close(self.quit)
+	if self.commits != nil {
+		close(self.commits)
+	}
+	self.wg.Wait()
+	self.quit = nil
+}
+
+func durability(ud interface{}, args []string) (result string, err error) {
+	context := ud.(*Context)
+	db := context.db
+	result = fmt.Sprintf("durability:%s\n%s", db.durability, db.syncStats.String())
+	return
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"levigo"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDurabilityModes(t *testing.T) {
+	for _, mode := range []string{DURABILITY_NONE, DURABILITY_PERIODIC, DURABILITY_SYNC} {
+		config := &LeveldbConfig{Dbname: filepath.Join(t.TempDir(), "db"), Durability: mode, SyncInterval: 10}
+		if err := config.setDefault(); err != nil {
+			t.Fatalf("invalid leveldb config:%v", err)
+		}
+		db := NewLeveldb(config)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					putFields(t, db, fmt.Sprintf("uid:%d:%d", i, j), map[string]string{"version": "1"})
+				}
+			}(i)
+		}
+		wg.Wait()
+		time.Sleep(30 * time.Millisecond)
+		snap := db.syncStats.Snapshot()
+		switch mode {
+		case DURABILITY_NONE:
+			if snap.Count != 0 {
+				t.Errorf("%s: %d fsyncs", mode, snap.Count)
+			}
+		case DURABILITY_PERIODIC:
+			if snap.Count == 0 || snap.Groups != 0 {
+				t.Errorf("%s: %d fsyncs, %d group commits", mode, snap.Count, snap.Groups)
+			}
+		case DURABILITY_SYNC:
+			if snap.Groups == 0 || snap.GroupSize*float64(snap.Groups) != 400 {
+				t.Errorf("%s: %d group commits of %.2f batches", mode, snap.Groups, snap.GroupSize)
+			}
+		}
+		db.Close()
+
+		db = NewLeveldb(config)
+		if n := countPrefix(db, DATA_KEY_START); n != 400 {
+			t.Errorf("%s: %d records after reopen, expect 400", mode, n)
+		}
+		db.Close()
+	}
+}
+
+// run a group committer on db over batches queued before it starts
+func startGroupCommit(db *Leveldb, n int) []*commitReq {
+	db.durability = DURABILITY_SYNC
+	db.commits = make(chan *commitReq, MAX_GROUP_COMMIT)
+	reqs := make([]*commitReq, n)
+	for i := range reqs {
+		batch := new(Batch)
+		batch.Put([]byte("k"), []byte(strconv.Itoa(i)))
+		reqs[i] = &commitReq{batch, make(chan error, 1)}
+		db.commits <- reqs[i]
+	}
+	db.wg.Add(1)
+	go db.groupCommit()
+	return reqs
+}
+
+func TestGroupCommitOrder(t *testing.T) {
+	db := newTestLeveldb(t, nil)
+	for _, req := range startGroupCommit(db, 10) {
+		if err := <-req.done; err != nil {
+			t.Fatalf("commit failed:%v", err)
+		}
+	}
+	// batches of a group are applied in the order they were queued
+	if value, _ := db.Get([]byte("k")); string(value) != "9" {
+		t.Errorf("value %s, expect the last batch", value)
+	}
+	if snap := db.syncStats.Snapshot(); snap.Groups != 1 || snap.GroupSize != 10 {
+		t.Errorf("%d group commits of %.2f batches, expect one of 10", snap.Groups, snap.GroupSize)
+	}
+}
+
+func TestGroupCommitError(t *testing.T) {
+	db := newTestLeveldb(t, nil)
+	failure := errors.New("disk full")
+	db.syncWrite = func(wb *levigo.WriteBatch) error {
+		return failure
+	}
+	reqs := startGroupCommit(db, 3)
+	for _, req := range reqs {
+		if err := <-req.done; err != failure {
+			t.Errorf("waiter got %v, expect the write error", err)
+		}
+	}
+	if err := db.Put([]byte("k2"), []byte("v")); err != failure {
+		t.Errorf("write got %v, expect the write error", err)
+	}
+}
+
+// batches queued when the database closes are still committed
+func TestGroupCommitFlushOnClose(t *testing.T) {
+	db := newTestLeveldb(t, nil)
+	reqs := startGroupCommit(db, 50)
+	db.stopDurability()
+	for _, req := range reqs {
+		select {
+		case err := <-req.done:
+			if err != nil {
+				t.Errorf("commit failed:%v", err)
+			}
+		default:
+			t.Fatalf("batch left uncommitted after close")
+		}
+	}
+	if value, _ := db.Get([]byte("k")); string(value) != "49" {
+		t.Errorf("value %s, expect the last batch", value)
+	}
+}
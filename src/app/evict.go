@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redis"
+)
+
+// delete KEYS[1] only if it still holds exactly the persisted fields in ARGV
+const EVICT_SCRIPT string = `
+if redis.call('hlen', KEYS[1]) * 2 ~= #ARGV then
+	return 0
+end
+for i = 1, #ARGV, 2 do
+	if redis.call('hget', KEYS[1], ARGV[i]) ~= ARGV[i + 1] then
+		return 0
+	end
+end
+return redis.call('del', KEYS[1])
+`
+
+// the longest matching prefix wins
+type EvictRule struct {
+	Prefix   string
+	IdleTime int  // seconds, overrides EvictConfig.IdleTime
+	Never    bool // keep keys with the prefix in redis
+}
+
+type EvictConfig struct {
+	Interval  int // seconds between passes, 0 disables eviction
+	IdleTime  int // seconds, evict keys idle longer than this, 0 means only under memory pressure
+	MaxMemory int // MB, evict keys idle longer than MinIdle while redis uses more than this
+	MinIdle   int // seconds, default 60
+	Batch     int // keys per scan, default 1000
+	Rules     []EvictRule
+}
+
+func (c *EvictConfig) setDefault() {
+	if c.MinIdle <= 0 {
+		c.MinIdle = 60
+	}
+	if c.Batch <= 0 {
+		c.Batch = 1000
+	}
+}
+
+type candidate struct {
+	key  string
+	idle int
+}
+
+// Evictor removes cold keys from redis once they are safely in leveldb, they
+// can be loaded back by agent Load or resp load
+type Evictor struct {
+	db      *Leveldb
+	redis   *Redis
+	config  *EvictConfig
+	trigger chan bool
+	quit    chan bool
+	wg      sync.WaitGroup
+
+	running  int32
+	passes   uint64
+	scanned  uint64
+	evicted  uint64
+	last_err atomic.Value
+}
+
+func (e *Evictor) rule(key string) *EvictRule {
+	var found *EvictRule
+	for i := range e.config.Rules {
+		r := &e.config.Rules[i]
+		if strings.HasPrefix(key, r.Prefix) && (found == nil || len(r.Prefix) > len(found.Prefix)) {
+			found = r
+		}
+	}
+	return found
+}
+
+// idle threshold of key in seconds, -1 if it must stay
+func (e *Evictor) threshold(key string, pressure bool) int {
+	idle := e.config.IdleTime
+	if r := e.rule(key); r != nil {
+		if r.Never {
+			return -1
+		}
+		if r.IdleTime > 0 {
+			idle = r.IdleTime
+		}
+	}
+	if pressure && (idle <= 0 || idle > e.config.MinIdle) {
+		idle = e.config.MinIdle
+	}
+	if idle <= 0 {
+		return -1
+	}
+	return idle
+}
+
+func (e *Evictor) eligible(key string, idle int, pressure bool) bool {
+	threshold := e.threshold(key, pressure)
+	return threshold >= 0 && idle >= threshold
+}
+
+func usedMemory(cli *redis.Redis) (int64, error) {
+	resp, err := cli.Exec("info", "memory")
+	if err != nil {
+		return 0, err
+	}
+	info, _ := resp.(string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if strings.HasPrefix(line, "used_memory:") {
+			return strconv.ParseInt(strings.TrimPrefix(line, "used_memory:"), 10, 64)
+		}
+	}
+	return 0, errors.New("no used_memory in info")
+}
+
+func (e *Evictor) underPressure(cli *redis.Redis) (bool, error) {
+	if e.config.MaxMemory <= 0 {
+		return false, nil
+	}
+	used, err := usedMemory(cli)
+	if err != nil {
+		return false, err
+	}
+	return used > int64(e.config.MaxMemory)*1024*1024, nil
+}
+
+// evict key if redis still holds what is persisted, keys with fields which
+// can't be restored from leveldb never match
+func (e *Evictor) evict(cli *redis.Redis, key string) (bool, error) {
+	rec, err := e.db.GetRecord(key)
+	if err != nil || rec == nil {
+		return false, err
+	}
+	fields := fieldRulesOf(key).Restored(rec.Fields)
+	if len(fields) == 0 {
+		return false, nil
+	}
+	ret, err := cli.Exec("eval", hashArgs(fields, EVICT_SCRIPT, 1, key)...)
+	if err != nil {
+		return false, err
+	}
+	return ret.(int) == 1, nil
+}
+
+func (e *Evictor) evictBatch(cli *redis.Redis, keys []string) error {
+	pressure, err := e.underPressure(cli)
+	if err != nil {
+		return err
+	}
+
+	candidates := make([]candidate, 0, len(keys))
+	for _, key := range keys {
+		if e.threshold(key, pressure) < 0 {
+			continue
+		}
+		resp, err := cli.Exec("object", "idletime", key)
+		if err != nil {
+			return err
+		}
+		if idle, ok := resp.(int); ok && e.eligible(key, idle, pressure) {
+			candidates = append(candidates, candidate{key, idle})
+		}
+	}
+	// coldest first, so memory pressure is relieved by the coldest keys
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].idle > candidates[j].idle })
+	for i, c := range candidates {
+		if pressure && i > 0 && i%100 == 0 {
+			if pressure, err = e.underPressure(cli); err != nil {
+				return err
+			}
+		}
+		// candidates picked under pressure must be idle enough on their own
+		if !pressure && !e.eligible(c.key, c.idle, false) {
+			continue
+		}
+		evicted, err := e.evict(cli, c.key)
+		if err != nil {
+			return err
+		}
+		if evicted {
+			atomic.AddUint64(&e.evicted, 1)
+			Info("evict key:%s, idle:%ds", c.key, c.idle)
+		}
+	}
+	return nil
+}
+
+func (e *Evictor) pass() error {
+	atomic.StoreInt32(&e.running, 1)
+	defer atomic.StoreInt32(&e.running, 0)
+
+	cli, err := e.redis.Connect()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	atomic.AddUint64(&e.passes, 1)
+	cursor := "0"
+	for {
+		select {
+		case <-e.quit:
+			return nil
+		default:
+		}
+		// TYPE needs redis >= 6
+		resp, err := cli.Exec("scan", cursor, "count", e.config.Batch, "type", "hash")
+		if err != nil {
+			return err
+		}
+		// [cursor, [key, ...]]
+		reply, ok := resp.([]interface{})
+		if !ok || len(reply) != 2 {
+			return fmt.Errorf("unexpected scan reply: %v", resp)
+		}
+		keys, _ := reply[1].([]string)
+		atomic.AddUint64(&e.scanned, uint64(len(keys)))
+		if err = e.evictBatch(cli, keys); err != nil {
+			return err
+		}
+		cursor, _ = reply[0].(string)
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+func (e *Evictor) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(e.config.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.trigger:
+		case <-e.quit:
+			return
+		}
+		if err := e.pass(); err != nil {
+			e.last_err.Store(err.Error())
+			Error("evict pass failed:%v", err)
+		}
+	}
+}
+
+func (e *Evictor) Start() {
+	e.wg.Add(1)
+	go e.run()
+	Info("start evictor, interval:%ds", e.config.Interval)
+}
+
+func (e *Evictor) Stop() {
+	close(e.quit)
+	e.wg.Wait()
+}
+
+func NewEvictor(db *Leveldb, redis *Redis, config *EvictConfig) *Evictor {
+	config.setDefault()
+	return &Evictor{
+		db:      db,
+		redis:   redis,
+		config:  config,
+		trigger: make(chan bool, 1),
+		quit:    make(chan bool),
+	}
+}
+
+// evict [run]
+func evict(ud interface{}, args []string) (result string, err error) {
+	context := ud.(*Context)
+	e := context.evictor
+	if e == nil {
+		err = errors.New("eviction is disabled")
+		return
+	}
+	if len(args) > 0 && args[0] == "run" {
+		select {
+		case e.trigger <- true:
+		default:
+		}
+		result = "triggered"
+		return
+	}
+	last_err, _ := e.last_err.Load().(string)
+	buf := bytes.NewBufferString("evictor:\n")
+	fmt.Fprintf(buf, "running:%v, passes:%d, scanned:%d, evicted:%d, last error:%s\n",
+		atomic.LoadInt32(&e.running) == 1, atomic.LoadUint64(&e.passes),
+		atomic.LoadUint64(&e.scanned), atomic.LoadUint64(&e.evicted), last_err)
+	result = buf.String()
+	return
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEvictEligible(t *testing.T) {
+	e := &Evictor{config: &EvictConfig{
+		IdleTime: 3600,
+		Rules: []EvictRule{
+			{Prefix: "session:", IdleTime: 600},
+			{Prefix: "session:admin:", Never: true},
+			{Prefix: "config:", Never: true},
+		},
+	}}
+	e.config.setDefault()
+
+	cases := []struct {
+		key      string
+		idle     int
+		pressure bool
+		eligible bool
+	}{
+		{"uid:1", 3600, false, true},
+		{"uid:1", 3599, false, false},
+		{"uid:1", 60, true, true},
+		{"uid:1", 59, true, false},
+		{"session:1", 600, false, true},
+		{"session:1", 599, false, false},
+		{"session:admin:1", 1 << 30, false, false},
+		{"session:admin:1", 1 << 30, true, false},
+		{"config:1", 1 << 30, true, false},
+	}
+	for _, c := range cases {
+		if eligible := e.eligible(c.key, c.idle, c.pressure); eligible != c.eligible {
+			t.Errorf("key:%s, idle:%d, pressure:%v, expect eligible:%v", c.key, c.idle, c.pressure, c.eligible)
+		}
+	}
+
+	// without idletime only memory pressure evicts
+	e.config.IdleTime = 0
+	if e.eligible("uid:1", 1<<30, false) || !e.eligible("uid:1", 60, true) {
+		t.Errorf("keys without idletime are evicted only under pressure")
+	}
+	if !e.eligible("session:1", 600, false) {
+		t.Errorf("rule idletime applies without pressure")
+	}
+}
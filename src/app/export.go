@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_CSV  = "csv"
+	FORMAT_RESP = "resp"
+)
+
+// iterate all persisted records whose key starts with prefix
+func foreachRecord(db *Leveldb, prefix string, cb func(rec *Record) error) (err error) {
+	it := db.NewIterator()
+	defer it.Close()
+
+	start := []byte(indexKey(prefix))
+	for it.Seek(start); it.Valid() && bytes.HasPrefix(it.Key(), start); it.Next() {
+		key := string(it.Key()[INDEX_KEY_LEN:])
+		var rec *Record
+		if rec, err = db.GetRecord(key); err != nil {
+			Error("read key:%s failed:%v", key, err)
+			return
+		}
+		if rec == nil {
+			Error("index without data, key:%s", key)
+			continue
+		}
+		if err = cb(rec); err != nil {
+			return
+		}
+	}
+	return it.GetError()
+}
+
+func writeRespCommand(w io.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+func exportRecords(db *Leveldb, format string, w io.Writer, prefix string) (count int, err error) {
+	var cw *csv.Writer
+	var encoder *json.Encoder
+	switch format {
+	case FORMAT_JSON:
+		encoder = json.NewEncoder(w)
+	case FORMAT_CSV:
+		cw = csv.NewWriter(w)
+		cw.Write([]string{"key", "version", "field", "value"})
+	case FORMAT_RESP:
+	default:
+		err = fmt.Errorf("unknown format: %s", format)
+		return
+	}
+
+	err = foreachRecord(db, prefix, func(rec *Record) error {
+		count++
+		if count%1000 == 0 {
+			Info("export progress:%d", count)
+		}
+		switch format {
+		case FORMAT_JSON:
+			return encoder.Encode(rec)
+		case FORMAT_CSV:
+			for field, value := range rec.Fields {
+				if err := cw.Write([]string{rec.Key, rec.Version, field, value}); err != nil {
+					return err
+				}
+			}
+		case FORMAT_RESP:
+			// commands for redis, in the form of redis
+			fields := fieldRulesOf(rec.Key).Restored(rec.Fields)
+			if len(fields) == 0 || rec.Ttl() == 0 {
+				return nil
+			}
+			args := make([]string, 0, len(fields)*2+2)
+			args = append(args, "HSET", rec.Key)
+			for field, value := range fields {
+				args = append(args, field, value)
+			}
+			writeRespCommand(w, args)
+			if rec.ExpireAt > 0 {
+				writeRespCommand(w, []string{"PEXPIREAT", rec.Key, strconv.FormatInt(rec.ExpireAt, 10)})
+			}
+		}
+		return nil
+	})
+	if cw != nil {
+		cw.Flush()
+		if err == nil {
+			err = cw.Error()
+		}
+	}
+	return
+}
+
+// limits of redis, checked before anything is allocated as the resp
+// listener parses commands before auth
+const (
+	RESP_MAX_INLINE = 64 * 1024
+	RESP_MAX_ARGS   = 1024 * 1024
+	RESP_MAX_BULK   = 512 * 1024 * 1024
+
+	// like redis, unauthenticated clients only get enough for AUTH
+	RESP_NOAUTH_MAX_ARGS = 10
+	RESP_NOAUTH_MAX_BULK = 16 * 1024
+)
+
+// read a line without the trailing \r\n
+func readRespLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > RESP_MAX_INLINE {
+			return "", errors.New("too big inline request")
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// parse the length after the type byte of a multibulk or bulk header
+func parseRespLength(line string, kind byte, max int) (int, error) {
+	if len(line) == 0 || line[0] != kind {
+		return 0, fmt.Errorf("malformed command: %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > max {
+		return 0, fmt.Errorf("invalid length: %q", line)
+	}
+	return n, nil
+}
+
+// read a multibulk command of at most maxArgs arguments of maxBulk bytes
+func readRespCommand(reader *bufio.Reader, maxArgs, maxBulk int) (args []string, err error) {
+	line, err := readRespLine(reader)
+	if err != nil {
+		return
+	}
+	n, err := parseRespLength(line, '*', maxArgs)
+	if err != nil {
+		return
+	}
+	// grow with the data received rather than the announced length
+	args = make([]string, 0)
+	for i := 0; i < n; i++ {
+		if line, err = readRespLine(reader); err != nil {
+			return
+		}
+		var sz int
+		if sz, err = parseRespLength(line, '$', maxBulk); err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if _, err = io.CopyN(&buf, reader, int64(sz)+2); err != nil {
+			return
+		}
+		arg := buf.Bytes()
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			err = fmt.Errorf("malformed argument, bulk length %d", sz)
+			return
+		}
+		args = append(args, string(arg[:sz]))
+	}
+	return
+}
+
+func importRecords(db *Leveldb, format string, r io.Reader, prefix string) (count int, err error) {
+	save := func(rec *Record) error {
+		if !strings.HasPrefix(rec.Key, prefix) {
+			return nil
+		}
+		if rec.Fields == nil {
+			rec.Fields = make(map[string]string)
+		}
+		if rec.Version == "" {
+			rec.Version = versionOf(rec.Fields)
+		}
+		if rec.Timestamp == 0 {
+			rec.Timestamp = time.Now().Unix()
+		}
+		count++
+		if count%1000 == 0 {
+			Info("import progress:%d", count)
+		}
+		return db.PutRecord(rec)
+	}
+
+	switch format {
+	case FORMAT_JSON:
+		decoder := json.NewDecoder(r)
+		for {
+			var rec Record
+			if err = decoder.Decode(&rec); err != nil {
+				break
+			}
+			if err = save(&rec); err != nil {
+				return
+			}
+		}
+	case FORMAT_CSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = 4
+		var rec *Record
+		var row []string
+		if _, err = cr.Read(); err != nil {
+			return
+		}
+		for {
+			if row, err = cr.Read(); err != nil {
+				break
+			}
+			// rows of one key are adjacent
+			if rec != nil && rec.Key != row[0] {
+				if err = save(rec); err != nil {
+					return
+				}
+				rec = nil
+			}
+			if rec == nil {
+				rec = &Record{Key: row[0], Type: "hash", Version: row[1], Fields: make(map[string]string)}
+			}
+			rec.Fields[row[2]] = row[3]
+		}
+		if rec != nil && err == io.EOF {
+			err = save(rec)
+		}
+	case FORMAT_RESP:
+		reader := bufio.NewReader(r)
+		var args []string
+		// saved on the next hset, a pexpireat may follow it
+		var rec *Record
+		for {
+			if args, err = readRespCommand(reader, RESP_MAX_ARGS, RESP_MAX_BULK); err != nil {
+				break
+			}
+			cmd := strings.ToLower(args[0])
+			if cmd == "pexpireat" && len(args) == 3 && rec != nil && rec.Key == args[1] {
+				if rec.ExpireAt, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+					return
+				}
+				continue
+			}
+			if (cmd != "hset" && cmd != "hmset") || len(args) < 4 || len(args)%2 != 0 {
+				err = fmt.Errorf("unsupported command: %s", args[0])
+				return
+			}
+			if rec != nil {
+				if err = save(rec); err != nil {
+					return
+				}
+			}
+			fields := make(map[string]string)
+			for i := 2; i < len(args)-1; i = i + 2 {
+				fields[args[i]] = args[i+1]
+			}
+			rec = &Record{Key: args[1], Type: "hash", Fields: fieldRulesOf(args[1]).Persisted(fields)}
+		}
+		if rec != nil && err == io.EOF {
+			err = save(rec)
+		}
+	default:
+		err = fmt.Errorf("unknown format: %s", format)
+		return
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// export <json|csv|resp> <file> [prefix]
+func export(ud interface{}, args []string) (result string, err error) {
+	if len(args) < 2 {
+		err = errors.New("export need format and file")
+		return
+	}
+	format, file, prefix := args[0], args[1], ""
+	if len(args) > 2 {
+		prefix = args[2]
+	}
+
+	context := ud.(*Context)
+	fp, err := os.Create(file)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+
+	w := bufio.NewWriter(fp)
+	count, err := exportRecords(context.db, format, w, prefix)
+	if err != nil {
+		Error("export to %s failed:%v", file, err)
+		return
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	Info("export finish, file:%s, count:%d", file, count)
+	result = fmt.Sprintf("export %d keys to %s", count, file)
+	return
+}
+
+// import <json|csv|resp> <file> [prefix]
+func import_(ud interface{}, args []string) (result string, err error) {
+	if len(args) < 2 {
+		err = errors.New("import need format and file")
+		return
+	}
+	format, file, prefix := args[0], args[1], ""
+	if len(args) > 2 {
+		prefix = args[2]
+	}
+
+	context := ud.(*Context)
+	fp, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+
+	count, err := importRecords(context.db, format, bufio.NewReader(fp), prefix)
+	if err != nil {
+		Error("import from %s failed:%v", file, err)
+		return
+	}
+	Info("import finish, file:%s, count:%d", file, count)
+	result = fmt.Sprintf("import %d keys from %s", count, file)
+	return
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// in-process redis holding hashes, with the scripts of the daemon built in
+type fakeRedis struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	hashes   map[string]map[string]string
+	expireAt map[string]int64 // unix ms
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed:%v", err)
+	}
+	r := &fakeRedis{ln: ln, hashes: make(map[string]map[string]string), expireAt: make(map[string]int64)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return r
+}
+
+func (r *fakeRedis) Addr() string {
+	return r.ln.Addr().String()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	w := &RespWriter{bufio.NewWriter(conn)}
+	for {
+		args, err := readRespCommand(reader, RESP_MAX_ARGS, RESP_MAX_BULK)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.exec(w, strings.ToLower(args[0]), args[1:])
+		r.mu.Unlock()
+		w.w.Flush()
+	}
+}
+
+// caller must hold the lock
+func (r *fakeRedis) hash(key string) map[string]string {
+	if at, ok := r.expireAt[key]; ok && at <= nowMs() {
+		delete(r.hashes, key)
+		delete(r.expireAt, key)
+	}
+	return r.hashes[key]
+}
+
+func (r *fakeRedis) hset(key string, pairs []string) {
+	h := r.hash(key)
+	if h == nil {
+		h = make(map[string]string)
+		r.hashes[key] = h
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		h[pairs[i]] = pairs[i+1]
+	}
+}
+
+func (r *fakeRedis) pexpire(key string, ms int64) int {
+	if r.hash(key) == nil {
+		return 0
+	}
+	r.expireAt[key] = nowMs() + ms
+	return 1
+}
+
+func (r *fakeRedis) del(key string) int {
+	if r.hash(key) == nil {
+		return 0
+	}
+	delete(r.hashes, key)
+	delete(r.expireAt, key)
+	return 1
+}
+
+func (r *fakeRedis) exec(w *RespWriter, cmd string, args []string) {
+	switch cmd {
+	case "select", "auth", "ping":
+		w.Status("OK")
+	case "type":
+		if r.hash(args[0]) != nil {
+			w.Status("hash")
+		} else {
+			w.Status("none")
+		}
+	case "hgetall":
+		h := r.hash(args[0])
+		w.ArrayHeader(len(h) * 2)
+		for k, v := range h {
+			w.Bulk(k)
+			w.Bulk(v)
+		}
+	case "hset", "hmset":
+		r.hset(args[0], args[1:])
+		w.Int(1)
+	case "pttl":
+		switch at, ok := r.expireAt[args[0]]; {
+		case r.hash(args[0]) == nil:
+			w.Int(-2)
+		case !ok:
+			w.Int(-1)
+		default:
+			w.Int(int(at - nowMs()))
+		}
+	case "expire", "pexpire":
+		n, _ := strconv.ParseInt(args[1], 10, 64)
+		if cmd == "expire" {
+			n *= 1000
+		}
+		w.Int(r.pexpire(args[0], n))
+	case "del":
+		w.Int(r.del(args[0]))
+	case "exists":
+		if r.hash(args[0]) != nil {
+			w.Int(1)
+		} else {
+			w.Int(0)
+		}
+	case "eval":
+		r.eval(w, args[0], args[2], args[3:])
+	default:
+		w.Error(fmt.Sprintf("ERR unknown command '%s'", cmd))
+	}
+}
+
+// redis fails to unpack more values than fit on the lua stack
+const LUA_MAX_UNPACK = 7999
+
+func (r *fakeRedis) eval(w *RespWriter, script, key string, argv []string) {
+	if strings.Contains(script, "unpack(ARGV, 2)") && len(argv)-1 > LUA_MAX_UNPACK {
+		w.Error("ERR Error running script: too many results to unpack")
+		return
+	}
+	switch script {
+	case LOAD_SCRIPT, REPLACE_SCRIPT:
+		if script == LOAD_SCRIPT && r.hash(key) != nil {
+			w.Int(0)
+			return
+		}
+		r.del(key)
+		r.hset(key, argv[1:])
+		if pttl, _ := strconv.ParseInt(argv[0], 10, 64); pttl > 0 {
+			r.pexpire(key, pttl)
+		}
+		w.Int(1)
+	default:
+		w.Error("ERR unknown script")
+	}
+}
+
+// set fields as the application does
+func (r *fakeRedis) Hset(key string, fields map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pairs := make([]string, 0, len(fields)*2)
+	for k, v := range fields {
+		pairs = append(pairs, k, v)
+	}
+	r.hset(key, pairs)
+}
+
+func (r *fakeRedis) Pexpire(key string, ms int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pexpire(key, ms)
+}
+
+func (r *fakeRedis) Del(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.del(key)
+}
+
+// remaining ttl in ms, -1 if none, -2 if the key is missing
+func (r *fakeRedis) Pttl(key string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hash(key) == nil {
+		return -2
+	}
+	if at, ok := r.expireAt[key]; ok {
+		return at - nowMs()
+	}
+	return -1
+}
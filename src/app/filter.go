@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+const REDACTED string = "[redacted]"
+
+// field rules of a namespace, applied in this order on the way into leveldb
+type FieldRules struct {
+	Include []string          // persist only these fields, all if empty
+	Exclude []string          // never persist these fields, e.g. session tokens
+	Redact  []string          // persist these fields with the value replaced
+	Hash    []string          // persist the hex sha256 of the value, hmac if HashKey is set
+	HashKey string            // secret of the hmac
+	Rename  map[string]string // redis field => leveldb field
+
+	include  map[string]bool
+	exclude  map[string]bool
+	redact   map[string]bool
+	hash     map[string]bool
+	unrename map[string]string // leveldb field => redis field
+}
+
+func fieldSet(fields []string) map[string]bool {
+	set := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		set[f] = true
+	}
+	return set
+}
+
+func (r *FieldRules) setDefault() error {
+	r.include = fieldSet(r.Include)
+	r.exclude = fieldSet(r.Exclude)
+	r.redact = fieldSet(r.Redact)
+	r.hash = fieldSet(r.Hash)
+	r.unrename = make(map[string]string, len(r.Rename))
+	for from, to := range r.Rename {
+		if _, ok := r.unrename[to]; ok {
+			return fmt.Errorf("fields renamed to the same %s", to)
+		}
+		if _, ok := r.Rename[to]; ok {
+			return fmt.Errorf("field %s renamed to %s which is renamed as well", from, to)
+		}
+		r.unrename[to] = from
+	}
+
+	// versions are compared on both sides, so the field must stay as it is
+	version := setting.Version.Field
+	if !r.persisted(version) || r.redact[version] || r.hash[version] || r.Rename[version] != "" {
+		return fmt.Errorf("version field %s must be persisted unchanged", version)
+	}
+	if from, ok := r.unrename[version]; ok {
+		return fmt.Errorf("field %s can't be renamed to the version field %s", from, version)
+	}
+	return nil
+}
+
+func (r *FieldRules) persisted(field string) bool {
+	return (len(r.include) == 0 || r.include[field]) && !r.exclude[field]
+}
+
+// a redis field named like a rename target is shadowed by the renamed one
+func (r *FieldRules) shadowed(field string) bool {
+	_, ok := r.unrename[field]
+	return ok
+}
+
+// the value in leveldb can be written back to redis
+func (r *FieldRules) restorable(field string) bool {
+	return r.persisted(field) && !r.redact[field] && !r.hash[field] && !r.shadowed(field)
+}
+
+func (r *FieldRules) hashValue(value string) string {
+	if r.HashKey == "" {
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, []byte(r.HashKey))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// fields of redis in the form persisted in leveldb
+func (r *FieldRules) Persisted(fields map[string]string) map[string]string {
+	out := make(map[string]string, len(fields))
+	for field, value := range fields {
+		if !r.persisted(field) {
+			continue
+		}
+		if r.shadowed(field) {
+			Debug("drop field %s shadowed by the rename of %s", field, r.unrename[field])
+			continue
+		}
+		if r.redact[field] {
+			value = REDACTED
+		} else if r.hash[field] {
+			value = r.hashValue(value)
+		}
+		if to, ok := r.Rename[field]; ok {
+			field = to
+		}
+		out[field] = value
+	}
+	return out
+}
+
+// fields of leveldb in the form of redis, without redacted and hashed ones
+func (r *FieldRules) Restored(fields map[string]string) map[string]string {
+	out := make(map[string]string, len(fields))
+	for field, value := range fields {
+		if from, ok := r.unrename[field]; ok {
+			field = from
+		}
+		if r.restorable(field) {
+			out[field] = value
+		}
+	}
+	return out
+}
+
+// fields of redis which leveldb can't restore, restore leaves them alone
+func (r *FieldRules) Untracked(fields map[string]string) map[string]string {
+	out := make(map[string]string)
+	for field, value := range fields {
+		if !r.restorable(field) {
+			out[field] = value
+		}
+	}
+	return out
+}
+
+var noFieldRules = &FieldRules{}
+
+// field rules of the namespace of key, none if it belongs to no namespace
+func fieldRulesOf(key string) *FieldRules {
+	if ns := namespaceOf(key); ns != nil {
+		return &ns.Fields
+	}
+	return noFieldRules
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFieldRulesSetDefault(t *testing.T) {
+	setVersion(t, VersionConfig{})
+	cases := map[string]struct {
+		rules FieldRules
+		ok    bool
+	}{
+		"none":                {FieldRules{}, true},
+		"rename":              {FieldRules{Rename: map[string]string{"nm": "name"}}, true},
+		"same target":         {FieldRules{Rename: map[string]string{"nm": "name", "n": "name"}}, false},
+		"chained":             {FieldRules{Rename: map[string]string{"nm": "name", "name": "full_name"}}, false},
+		"swapped":             {FieldRules{Rename: map[string]string{"a": "b", "b": "a"}}, false},
+		"to version":          {FieldRules{Rename: map[string]string{"ver": "version"}}, false},
+		"version renamed":     {FieldRules{Rename: map[string]string{"version": "ver"}}, false},
+		"version excluded":    {FieldRules{Exclude: []string{"version"}}, false},
+		"version not include": {FieldRules{Include: []string{"name"}}, false},
+		"version included":    {FieldRules{Include: []string{"name", "version"}}, true},
+		"version redacted":    {FieldRules{Redact: []string{"version"}}, false},
+		"version hashed":      {FieldRules{Hash: []string{"version"}}, false},
+	}
+	for name, c := range cases {
+		if err := c.rules.setDefault(); (err == nil) != c.ok {
+			t.Errorf("%s: err:%v", name, err)
+		}
+	}
+}
+
+func TestFieldRulesPersisted(t *testing.T) {
+	setVersion(t, VersionConfig{})
+	redis := map[string]string{"version": "1", "nm": "foo", "token": "t", "password": "p", "phone": "123"}
+	cases := map[string]struct {
+		rules              FieldRules
+		persisted, restore map[string]string
+	}{
+		"none": {
+			FieldRules{},
+			redis,
+			redis,
+		},
+		"include": {
+			FieldRules{Include: []string{"version", "nm"}},
+			map[string]string{"version": "1", "nm": "foo"},
+			map[string]string{"version": "1", "nm": "foo"},
+		},
+		"exclude": {
+			FieldRules{Exclude: []string{"token", "password", "phone"}},
+			map[string]string{"version": "1", "nm": "foo"},
+			map[string]string{"version": "1", "nm": "foo"},
+		},
+		"redact": {
+			FieldRules{Redact: []string{"password"}, Exclude: []string{"token", "phone"}},
+			map[string]string{"version": "1", "nm": "foo", "password": REDACTED},
+			map[string]string{"version": "1", "nm": "foo"},
+		},
+		"hash": {
+			FieldRules{Hash: []string{"phone"}, Include: []string{"version", "phone"}},
+			map[string]string{"version": "1", "phone": "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3"},
+			map[string]string{"version": "1"},
+		},
+		"hmac": {
+			FieldRules{Hash: []string{"phone"}, HashKey: "secret", Include: []string{"version", "phone"}},
+			map[string]string{"version": "1", "phone": "77de38e4b50e618a0ebb95db61e2f42697391659d82c064a5f81b9f48d85ccd5"},
+			map[string]string{"version": "1"},
+		},
+		"rename": {
+			FieldRules{Rename: map[string]string{"nm": "name"}, Include: []string{"version", "nm"}},
+			map[string]string{"version": "1", "name": "foo"},
+			map[string]string{"version": "1", "nm": "foo"},
+		},
+		"rename shadows": {
+			FieldRules{Rename: map[string]string{"nm": "token"}, Include: []string{"version", "nm", "token"}},
+			map[string]string{"version": "1", "token": "foo"},
+			map[string]string{"version": "1", "nm": "foo"},
+		},
+	}
+	for name, c := range cases {
+		if err := c.rules.setDefault(); err != nil {
+			t.Fatalf("%s: invalid rules:%v", name, err)
+		}
+		// a map with colliding fields must persist the same way every time
+		for i := 0; i < 10; i++ {
+			persisted := c.rules.Persisted(redis)
+			if !reflect.DeepEqual(persisted, c.persisted) {
+				t.Errorf("%s: persisted %v, expect %v", name, persisted, c.persisted)
+				break
+			}
+		}
+		if restored := c.rules.Restored(c.persisted); !reflect.DeepEqual(restored, c.restore) {
+			t.Errorf("%s: restored %v, expect %v", name, restored, c.restore)
+		}
+	}
+}
+
+func TestFieldRulesUntracked(t *testing.T) {
+	setVersion(t, VersionConfig{})
+	rules := FieldRules{Exclude: []string{"token"}, Redact: []string{"password"}, Rename: map[string]string{"nm": "name"}}
+	if err := rules.setDefault(); err != nil {
+		t.Fatalf("invalid rules:%v", err)
+	}
+	fields := map[string]string{"version": "1", "nm": "foo", "name": "bar", "token": "t", "password": "p"}
+	expect := map[string]string{"name": "bar", "token": "t", "password": "p"}
+	if untracked := rules.Untracked(fields); !reflect.DeepEqual(untracked, expect) {
+		t.Errorf("untracked %v, expect %v", untracked, expect)
+	}
+}
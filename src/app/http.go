@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// rest api over the manager and agent handlers
+type HttpSvr struct {
+	context *Context
+	svr     *http.Server
+	mux     *http.ServeMux
+	wg      sync.WaitGroup
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		code = http.StatusInternalServerError
+		body, _ = json.Marshal(httpError{err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJson(w, code, httpError{err.Error()})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJson(w, http.StatusMethodNotAllowed, httpError{"method not allowed"})
+		return false
+	}
+	return true
+}
+
+// the context of ?source=, the default source if it's absent
+func (self *HttpSvr) contextOf(w http.ResponseWriter, r *http.Request) *Context {
+	name := r.URL.Query().Get("source")
+	if name == "" {
+		return self.context
+	}
+	context := self.context.withSource(name)
+	if context == nil {
+		writeJson(w, http.StatusNotFound, httpError{"unknown source: " + name})
+	}
+	return context
+}
+
+// GET /keys?prefix=&cursor=&count=&source=
+func (self *HttpSvr) handleScan(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	context := self.contextOf(w, r)
+	if context == nil {
+		return
+	}
+	query := r.URL.Query()
+	params := map[string]interface{}{
+		"prefix": query.Get("prefix"),
+		"cursor": query.Get("cursor"),
+	}
+	if count, err := strconv.Atoi(query.Get("count")); err == nil {
+		params["count"] = float64(count)
+	}
+	result, err := handlerScan(context.Source, params)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, result)
+}
+
+// GET /keys/{key}?source= and GET /keys/{key}/diff?source=
+func (self *HttpSvr) handleKey(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	context := self.contextOf(w, r)
+	if context == nil {
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+	if strings.HasSuffix(key, "/diff") {
+		self.handleDiff(w, context, strings.TrimSuffix(key, "/diff"))
+		return
+	}
+
+	rec, err := context.db.GetRecord(key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if rec == nil {
+		writeJson(w, http.StatusNotFound, httpError{"key doesn't exist on leveldb"})
+		return
+	}
+	writeJson(w, http.StatusOK, rec)
+}
+
+func (self *HttpSvr) handleDiff(w http.ResponseWriter, context *Context, key string) {
+	cli, err := context.config.Connect()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer cli.Close()
+
+	d, err := diffKey(context.db, cli, key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if d == nil {
+		writeJson(w, http.StatusNotFound, httpError{"key doesn't exist on leveldb"})
+		return
+	}
+	writeJson(w, http.StatusOK, d)
+}
+
+// POST /sync/{key}?source=
+func (self *HttpSvr) handleSync(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	context := self.contextOf(w, r)
+	if context == nil {
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/sync/")
+	args := []string{key}
+	if r.URL.Query().Get("force") == "1" {
+		args = append(args, "force")
+	}
+	if _, err := sync_one(context, args); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusAccepted, map[string]string{"key": key})
+}
+
+// POST /restore/{key}?policy=&host=&password=&db=&from=&to=&ns=&source=
+func (self *HttpSvr) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	context := self.contextOf(w, r)
+	if context == nil {
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/restore/")
+	args := make([]string, 0)
+	for name, values := range r.URL.Query() {
+		if name != "source" {
+			args = append(args, name+"="+values[0])
+		}
+	}
+	opts, err := parseRestoreOptions(context.config, args)
+	if err == nil && !opts.Match(key) {
+		err = errors.New("key doesn't match from or ns")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	cli, err := opts.Connect()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer cli.Close()
+
+	if err = restore(context, key, cli, opts); err == RecordExpired {
+		writeError(w, http.StatusGone, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]string{"key": opts.TargetKey(key)})
+}
+
+// GET /stats?source=
+func (self *HttpSvr) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	context := self.contextOf(w, r)
+	if context == nil {
+		return
+	}
+	storer_queues := make([]int, len(context.s.queues))
+	for i, queue := range context.s.queues {
+		storer_queues[i] = len(queue)
+	}
+	sizes := context.db.Sizes(leveldbRanges)
+	stats := map[string]interface{}{
+		"sync_queue":    len(context.sync_queue),
+		"storer_queues": storer_queues,
+		"durability":    context.db.durability,
+		"fsync":         context.db.syncStats.Snapshot(),
+		"data_size":     sizes[0],
+		"index_size":    sizes[1],
+		"migrate":       context.migrator.Status(),
+		"conflicts":     context.db.conflicts.Snapshot(),
+	}
+	writeJson(w, http.StatusOK, stats)
+}
+
+// GET /health, ok only if the redis of every source is reachable
+func (self *HttpSvr) handleHealth(w http.ResponseWriter, r *http.Request) {
+	for _, src := range self.context.sources {
+		cli, err := src.config.Connect()
+		if err != nil {
+			writeJson(w, http.StatusServiceUnavailable, map[string]string{
+				"status": "redis unavailable", "source": src.name, "error": err.Error()})
+			return
+		}
+		cli.Close()
+	}
+	writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// reject requests without a bearer token of at least role
+func (self *HttpSvr) guard(role int, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := httpRole(r)
+		if got == ROLE_NONE {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, AuthRequired)
+			return
+		}
+		if got < role {
+			writeError(w, http.StatusForbidden, PermissionDenied)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (self *HttpSvr) Start() {
+	self.wg.Add(1)
+	defer self.wg.Done()
+
+	ln, err := listen(setting.Http.Addr, &setting.Http.Tls)
+	if err != nil {
+		Panic("start http failed:%v", err)
+	}
+	Info("start http succeed:%s", setting.Http.Addr)
+
+	if err = self.svr.Serve(ln); err != nil && err != http.ErrServerClosed {
+		Error("http exit:%v", err)
+	}
+}
+
+func (self *HttpSvr) Stop() {
+	self.svr.Close()
+	self.wg.Wait()
+}
+
+func NewHttpSvr(context *Context) *HttpSvr {
+	self := &HttpSvr{context: context}
+	self.mux = http.NewServeMux()
+	self.mux.HandleFunc("/keys", self.guard(ROLE_READ, self.handleScan))
+	self.mux.HandleFunc("/keys/", self.guard(ROLE_READ, self.handleKey))
+	self.mux.HandleFunc("/sync/", self.guard(ROLE_OPERATOR, self.handleSync))
+	self.mux.HandleFunc("/restore/", self.guard(ROLE_OPERATOR, self.handleRestore))
+	self.mux.HandleFunc("/stats", self.guard(ROLE_READ, self.handleStats))
+	// left open for load balancer probes
+	self.mux.HandleFunc("/health", self.handleHealth)
+	self.svr = &http.Server{Handler: self.mux}
+	return self
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestHttpSvr(t *testing.T, host string) *HttpSvr {
+	src := &Source{
+		name:       "default",
+		config:     &Redis{Host: host},
+		db:         newTestLeveldb(t, nil),
+		sync_queue: make(chan *SyncTask, 10),
+	}
+	putFields(t, src.db, "uid:1", map[string]string{"version": "1", "name": "a"})
+	return NewHttpSvr(&Context{Source: src, sources: []*Source{src}})
+}
+
+func TestHttpAuth(t *testing.T) {
+	old := setting.Auth
+	setting.Auth.Credentials = []Credential{
+		{Name: "app", Token: "read-token", Role: "read"},
+		{Name: "ops", Token: "ops-token", Role: "operator"},
+	}
+	t.Cleanup(func() { setting.Auth = old })
+	svr := newTestHttpSvr(t, "127.0.0.1:1")
+
+	for _, c := range []struct {
+		method, path, token string
+		code                int
+	}{
+		{"GET", "/keys/uid:1", "", http.StatusUnauthorized},
+		{"GET", "/keys/uid:1", "bad-token", http.StatusUnauthorized},
+		{"GET", "/keys/uid:1", "read-token", http.StatusOK},
+		{"GET", "/keys", "read-token", http.StatusOK},
+		{"POST", "/sync/uid:1", "read-token", http.StatusForbidden},
+		{"POST", "/sync/uid:1", "ops-token", http.StatusAccepted},
+		{"POST", "/restore/uid:1", "read-token", http.StatusForbidden},
+		// health is left open
+		{"GET", "/health", "", http.StatusServiceUnavailable},
+	} {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		svr.mux.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s %s with %q: expect %d, got %d %s", c.method, c.path, c.token, c.code, w.Code, w.Body)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s %s: no WWW-Authenticate", c.method, c.path)
+		}
+	}
+	if len(svr.context.sync_queue) != 1 {
+		t.Errorf("expect 1 sync task, got %d", len(svr.context.sync_queue))
+	}
+}
+
+func TestHttpHandlers(t *testing.T) {
+	redis := startFakeRedis(t)
+	svr := newTestHttpSvr(t, redis.Addr())
+
+	for _, c := range []struct {
+		method, path string
+		code         int
+		body         string // expected in the response body
+	}{
+		{"GET", "/keys/uid:1", http.StatusOK, `"name":"a"`},
+		{"GET", "/keys/uid:404", http.StatusNotFound, "doesn't exist"},
+		{"GET", "/keys?count=1", http.StatusOK, `"uid:1"`},
+		{"GET", "/keys/uid:1?source=nope", http.StatusNotFound, "unknown source: nope"},
+		{"POST", "/keys/uid:1", http.StatusMethodNotAllowed, "method not allowed"},
+		{"GET", "/sync/uid:1", http.StatusMethodNotAllowed, "method not allowed"},
+		{"POST", "/sync/uid:1?force=1", http.StatusAccepted, `"key":"uid:1"`},
+		{"POST", "/restore/uid:1?bogus=1", http.StatusBadRequest, "unknown restore option: bogus"},
+		{"POST", "/restore/uid:404", http.StatusInternalServerError, "error"},
+		{"POST", "/restore/uid:1", http.StatusOK, `"key":"uid:1"`},
+		{"GET", "/keys/uid:1/diff", http.StatusOK, "uid:1"},
+		{"GET", "/health", http.StatusOK, `"status":"ok"`},
+	} {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		w := httptest.NewRecorder()
+		svr.mux.ServeHTTP(w, r)
+		if w.Code != c.code || !strings.Contains(w.Body.String(), c.body) {
+			t.Errorf("%s %s: expect %d %s, got %d %s", c.method, c.path, c.code, c.body, w.Code, w.Body)
+		}
+		if w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") == "" {
+			t.Errorf("%s %s: no Allow header", c.method, c.path)
+		}
+	}
+	if redis.Pttl("uid:1") == -2 {
+		t.Errorf("uid:1 isn't restored to redis")
+	}
+}
+
+func TestAgentHttp(t *testing.T) {
+	old := setting.Auth
+	setting.Auth.Credentials = []Credential{{Name: "app", Token: "secret", Role: "admin"}}
+	t.Cleanup(func() { setting.Auth = old })
+	svr, _ := startTestAgent(t)
+
+	call := func(method, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		svr.ServeHTTP(w, r)
+		return w
+	}
+	big := `{"id":1,"method":"Slow","params":"` + strings.Repeat("x", AGENT_NOAUTH_MAX_FRAME) + `"}`
+	for _, c := range []struct {
+		name, method, token, body string
+		code                      int
+		reply                     string
+	}{
+		{"get", "GET", "secret", "", http.StatusMethodNotAllowed, ""},
+		{"call", "POST", "secret", `{"id":1,"method":"Slow","params":0}`, http.StatusOK, `"result":"done"`},
+		{"no token", "POST", "", `{"id":1,"method":"Slow","params":0}`, http.StatusOK, `"code":-32001`},
+		{"notification", "POST", "secret", `{"method":"Slow","params":0}`, http.StatusNoContent, ""},
+		{"big before auth", "POST", "", big, http.StatusRequestEntityTooLarge, ""},
+		{"big after auth", "POST", "secret", big, http.StatusOK, `"result":"done"`},
+	} {
+		w := call(c.method, c.token, c.body)
+		if w.Code != c.code || !strings.Contains(w.Body.String(), c.reply) {
+			t.Errorf("%s: expect %d %s, got %d %s", c.name, c.code, c.reply, w.Code, w.Body)
+		}
+	}
+}
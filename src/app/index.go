@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// secondary index entry: INTERNAL_PREFIX '#' field '\0' value '\0' key => ""
+const FIELD_INDEX_PREFIX string = INTERNAL_PREFIX + "#"
+
+func fieldIndexPrefix(field, value string) []byte {
+	return []byte(FIELD_INDEX_PREFIX + field + "\x00" + value + "\x00")
+}
+
+func fieldIndexKey(field, value, key string) []byte {
+	return append(fieldIndexPrefix(field, value), key...)
+}
+
+// add index maintenance of rec into batch, old is the replaced record or nil
+func (self *Leveldb) indexRecord(batch *Batch, old, rec *Record) {
+	for _, field := range self.indexes {
+		value, ok := rec.Fields[field]
+		if old != nil {
+			if old_value, old_ok := old.Fields[field]; old_ok {
+				if ok && old_value == value {
+					continue
+				}
+				batch.Delete(fieldIndexKey(field, old_value, old.Key))
+			}
+		}
+		if ok {
+			batch.Put(fieldIndexKey(field, value, rec.Key), nil)
+		}
+	}
+}
+
+func (self *Leveldb) IsIndexed(field string) bool {
+	for _, f := range self.indexes {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// return at most count keys whose field equals value
+func (self *Leveldb) Find(field, value string, count int) (keys []string, err error) {
+	if !self.IsIndexed(field) {
+		err = fmt.Errorf("field %s is not indexed", field)
+		return
+	}
+
+	it := self.NewIterator()
+	defer it.Close()
+
+	prefix := fieldIndexPrefix(field, value)
+	keys = make([]string, 0)
+	for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		if count > 0 && len(keys) >= count {
+			break
+		}
+		keys = append(keys, string(it.Key()[len(prefix):]))
+	}
+	err = it.GetError()
+	return
+}
+
+// find <field> <value> [count]
+func find(ud interface{}, args []string) (result string, err error) {
+	if len(args) < 2 {
+		err = errors.New("find need field and value")
+		return
+	}
+	count := 100
+	if len(args) > 2 {
+		if count, err = strconv.Atoi(args[2]); err != nil {
+			return
+		}
+	}
+
+	context := ud.(*Context)
+	keys, err := context.db.Find(args[0], args[1], count)
+	if err != nil {
+		return
+	}
+
+	buf := bytes.NewBufferString("keys:\n")
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s\n", key)
+	}
+	result = buf.String()
+	return
+}
+
+// drop every index entry of field, stale ones included
+func (self *Leveldb) clearFieldIndex(field string) (count int, err error) {
+	it := self.NewIterator()
+	defer it.Close()
+
+	batch := new(Batch)
+	prefix := []byte(FIELD_INDEX_PREFIX + field + "\x00")
+	for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		batch.Delete(it.Key())
+		count++
+		if count%MIGRATE_BATCH == 0 {
+			if err = self.Write(batch); err != nil {
+				return
+			}
+			batch = new(Batch)
+		}
+	}
+	if err = it.GetError(); err != nil {
+		return
+	}
+	err = self.Write(batch)
+	return
+}
+
+// rebuild index entries of all records, used after changing indexes
+func reindex(ud interface{}, args []string) (result string, err error) {
+	context := ud.(*Context)
+	db := context.db
+
+	cleared := 0
+	for _, field := range db.indexes {
+		var n int
+		if n, err = db.clearFieldIndex(field); err != nil {
+			return
+		}
+		cleared += n
+	}
+
+	count := 0
+	err = foreachRecord(db, "", func(rec *Record) error {
+		// the record may have changed since the iterator read it
+		l := db.Lock(rec.Key)
+		defer l.Unlock()
+		rec, err := db.GetRecord(rec.Key)
+		if rec == nil || err != nil {
+			return err
+		}
+		batch := new(Batch)
+		db.indexRecord(batch, nil, rec)
+		if batch.Len() == 0 {
+			return nil
+		}
+		count++
+		return db.Write(batch)
+	})
+	if err != nil {
+		return
+	}
+	result = fmt.Sprintf("reindex %d keys, %d old entries cleared", count, cleared)
+	return
+}
+
+func handlerFind(ud interface{}, params interface{}) (result interface{}, err error) {
+	src := ud.(*Source)
+	args, ok := params.(map[string]interface{})
+	if !ok {
+		err = invalidParams("params should be object")
+		return
+	}
+	field, _ := args["field"].(string)
+	value, _ := args["value"].(string)
+	count := 100
+	if n, ok := args["count"].(float64); ok {
+		count = int(n)
+	}
+	Info("agent find:%s=%s", field, value)
+	keys, err := src.db.Find(field, value, count)
+	if err != nil {
+		Error("find %s=%s failed:%v", field, value, err)
+		return
+	}
+	result = keys
+	return
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReindex(t *testing.T) {
+	db := newTestLeveldb(t, &LeveldbConfig{Indexes: []string{"name"}})
+	for key, name := range map[string]string{"uid:1": "foo", "uid:2": "bar"} {
+		rec := &Record{Key: key, Version: "1", Fields: map[string]string{"version": "1", "name": name}}
+		if err := db.PutRecord(rec); err != nil {
+			t.Fatalf("put record failed:%v", err)
+		}
+	}
+	// left behind by an older index or a crash
+	db.Put(fieldIndexKey("name", "old", "uid:1"), nil)
+	db.Put(fieldIndexKey("name", "foo", "uid:9"), nil)
+
+	context := &Context{Source: &Source{db: db}}
+	if _, err := reindex(context, nil); err != nil {
+		t.Fatalf("reindex failed:%v", err)
+	}
+
+	expect := map[string][]string{"foo": {"uid:1"}, "bar": {"uid:2"}, "old": {}}
+	for value, keys := range expect {
+		found, err := db.Find("name", value, 0)
+		if err != nil {
+			t.Fatalf("find failed:%v", err)
+		}
+		if !reflect.DeepEqual(found, keys) {
+			t.Errorf("name=%s, expect %v, got %v", value, keys, found)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// json-rpc 2.0, requests without "jsonrpc" are accepted for old clients
+const JSONRPC_VERSION string = "2.0"
+
+var nullId = json.RawMessage("null")
+
+type Request struct {
+	Jsonrpc string
+	Id      json.RawMessage // nil for notification
+	Method  string
+	Params  interface{}
+}
+
+type Response struct {
+	Id     json.RawMessage
+	Result interface{}
+	Error  *AgentError
+}
+
+// result and error are mutually exclusive
+func (r *Response) MarshalJSON() ([]byte, error) {
+	id := r.Id
+	if id == nil {
+		id = nullId
+	}
+	if r.Error != nil {
+		return json.Marshal(struct {
+			Jsonrpc string          `json:"jsonrpc"`
+			Error   *AgentError     `json:"error"`
+			Id      json.RawMessage `json:"id"`
+		}{JSONRPC_VERSION, r.Error, id})
+	}
+	return json.Marshal(struct {
+		Jsonrpc string          `json:"jsonrpc"`
+		Result  interface{}     `json:"result"`
+		Id      json.RawMessage `json:"id"`
+	}{JSONRPC_VERSION, r.Result, id})
+}
+
+func parseRequest(raw json.RawMessage) (req *Request, err *AgentError) {
+	var fields map[string]json.RawMessage
+	if e := json.Unmarshal(raw, &fields); e != nil {
+		err = &AgentError{ERR_INVALID_REQUEST, "request should be object"}
+		return
+	}
+
+	req = new(Request)
+	// a missing id means notification, but an explicit null doesn't
+	if id, ok := fields["id"]; ok {
+		switch id[0] {
+		case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		default:
+			// an invalid id isn't echoed back, the error goes with null
+			err = &AgentError{ERR_INVALID_REQUEST, "id should be string, number or null"}
+			return
+		}
+		req.Id = id
+	}
+	if v, ok := fields["jsonrpc"]; ok {
+		if e := json.Unmarshal(v, &req.Jsonrpc); e != nil || req.Jsonrpc != JSONRPC_VERSION {
+			err = &AgentError{ERR_INVALID_REQUEST, "jsonrpc should be \"2.0\""}
+			return
+		}
+	}
+	if e := json.Unmarshal(fields["method"], &req.Method); e != nil || req.Method == "" {
+		err = &AgentError{ERR_INVALID_REQUEST, "method should be string"}
+		return
+	}
+	if v, ok := fields["params"]; ok {
+		if e := json.Unmarshal(v, &req.Params); e != nil {
+			err = &AgentError{ERR_INVALID_PARAMS, e.Error()}
+			return
+		}
+	}
+	return
+}
+
+// return nil for notification
+func (self *AgentSvr) handleRequest(raw json.RawMessage, sess *AgentSession) (resp *Response) {
+	req, err := parseRequest(raw)
+	if err != nil {
+		resp = &Response{Error: err}
+		if req != nil {
+			resp.Id = req.Id
+		}
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			Error("handle agent request:%s failed:%v", req.Method, e)
+			if req.Id != nil {
+				resp = &Response{Id: req.Id, Error: &AgentError{ERR_INTERNAL, fmt.Sprint(e)}}
+			}
+		}
+	}()
+	result, err := self.call(req.Method, req.Params, sess)
+	if req.Id == nil {
+		return
+	}
+	return &Response{Id: req.Id, Result: result, Error: err}
+}
+
+func encodeResponse(v interface{}) []byte {
+	body, err := json.Marshal(v)
+	if err != nil {
+		Error("marshal response failed:%v", err)
+		body, _ = json.Marshal(&Response{Error: &AgentError{ERR_INTERNAL, err.Error()}})
+	}
+	return body
+}
+
+// handle a single or batch request, return nil if there is nothing to reply
+func (self *AgentSvr) handleMessage(body []byte, sess *AgentSession) []byte {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		var raw json.RawMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return encodeResponse(&Response{Error: &AgentError{ERR_PARSE, err.Error()}})
+		}
+		if resp := self.handleRequest(raw, sess); resp != nil {
+			return encodeResponse(resp)
+		}
+		return nil
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return encodeResponse(&Response{Error: &AgentError{ERR_PARSE, err.Error()}})
+	}
+	if len(batch) == 0 {
+		return encodeResponse(&Response{Error: &AgentError{ERR_INVALID_REQUEST, "empty batch"}})
+	}
+	resps := make([]*Response, 0, len(batch))
+	for _, raw := range batch {
+		if resp := self.handleRequest(raw, sess); resp != nil {
+			resps = append(resps, resp)
+		}
+	}
+	if len(resps) == 0 {
+		return nil
+	}
+	return encodeResponse(resps)
+}
+
+func (self *AgentSvr) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// same frame limits as the tcp agent
+	role := httpRole(r)
+	limit := setting.Agent.MaxFrame
+	if role == ROLE_NONE {
+		limit = AGENT_NOAUTH_MAX_FRAME
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(limit)))
+	if err != nil && len(body) >= limit {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reply := self.handleMessage(body, &AgentSession{role: role})
+	if reply == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(reply)
+}
+
+// optional, serve json-rpc over http post
+func (self *AgentSvr) StartHttp() {
+	if self.httpSvr == nil {
+		return
+	}
+	self.wg.Add(1)
+	defer self.wg.Done()
+
+	ln, err := listen(setting.Agent.HttpAddr, &setting.Agent.Tls)
+	if err != nil {
+		Panic("start agent http failed:%v", err)
+	}
+	Info("start agent http succeed:%s", setting.Agent.HttpAddr)
+
+	if err = self.httpSvr.Serve(ln); err != nil && err != http.ErrServerClosed {
+		Error("agent http exit:%v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHandleMessage(t *testing.T) {
+	svr, _ := startTestAgent(t)
+	sess := &AgentSession{role: ROLE_ADMIN}
+
+	for _, c := range []struct {
+		name   string
+		body   string
+		expect string // empty for no reply
+	}{
+		{"call", `{"jsonrpc":"2.0","id":1,"method":"Slow","params":0}`,
+			`{"jsonrpc":"2.0","result":"done","id":1}`},
+		{"string id", `{"jsonrpc":"2.0","id":"a","method":"Slow","params":0}`,
+			`{"jsonrpc":"2.0","result":"done","id":"a"}`},
+		{"null id", `{"jsonrpc":"2.0","id":null,"method":"Slow","params":0}`,
+			`{"jsonrpc":"2.0","result":"done","id":null}`},
+		{"old client", `{"id":2,"method":"Slow","params":0}`,
+			`{"jsonrpc":"2.0","result":"done","id":2}`},
+		{"notification", `{"jsonrpc":"2.0","method":"Slow","params":0}`, ""},
+		{"unknown notification", `{"jsonrpc":"2.0","method":"Nope"}`, ""},
+		{"unknown method", `{"jsonrpc":"2.0","id":3,"method":"Nope"}`,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"unknown method: Nope"},"id":3}`},
+		{"object id", `{"jsonrpc":"2.0","id":{},"method":"Slow"}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"id should be string, number or null"},"id":null}`},
+		{"array id", `{"jsonrpc":"2.0","id":[1],"method":"Slow"}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"id should be string, number or null"},"id":null}`},
+		{"bool id", `{"jsonrpc":"2.0","id":true,"method":"Slow"}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"id should be string, number or null"},"id":null}`},
+		{"bad version", `{"jsonrpc":"1.0","id":4,"method":"Slow"}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"jsonrpc should be \"2.0\""},"id":4}`},
+		{"no method", `{"jsonrpc":"2.0","id":5}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"method should be string"},"id":5}`},
+		{"not object", `1`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"request should be object"},"id":null}`},
+		{"parse error", `{"jsonrpc":`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"unexpected end of JSON input"},"id":null}`},
+		{"batch parse error", `[{"jsonrpc":"2.0","method":"Slow"},`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"unexpected end of JSON input"},"id":null}`},
+		{"empty body", ``,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"unexpected end of JSON input"},"id":null}`},
+		{"empty batch", `[]`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"empty batch"},"id":null}`},
+		{"batch", ` [{"jsonrpc":"2.0","id":1,"method":"Slow","params":0},
+			{"jsonrpc":"2.0","method":"Slow","params":0},
+			1,
+			{"jsonrpc":"2.0","id":"b","method":"Nope"}]`,
+			`[{"jsonrpc":"2.0","result":"done","id":1},` +
+				`{"jsonrpc":"2.0","error":{"code":-32600,"message":"request should be object"},"id":null},` +
+				`{"jsonrpc":"2.0","error":{"code":-32601,"message":"unknown method: Nope"},"id":"b"}]`},
+		{"batch of notifications", `[{"jsonrpc":"2.0","method":"Slow","params":0},{"method":"Slow","params":0}]`, ""},
+	} {
+		reply := svr.handleMessage([]byte(c.body), sess)
+		if string(reply) != c.expect {
+			t.Errorf("%s: expect %s, got %s", c.name, c.expect, reply)
+		}
+	}
+}
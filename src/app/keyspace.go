@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"levigo"
+)
+
+const KEYSPACE_VERSION string = "2"
+
+var KEYSPACE_KEY = []byte(INTERNAL_PREFIX + "@keyspace")
+
+// the legacy keyspace stores records under the raw redis key, next to
+// internal entries starting with '|', '#', '$' and '%'
+const (
+	LEGACY_INDEX_PREFIX  = "|"
+	LEGACY_CHANGE_PREFIX = "$"
+	LEGACY_SINK_PREFIX   = "%"
+)
+
+const MIGRATE_BATCH int = 1000
+
+// refuse to serve a legacy database, mark an empty one as current
+func (self *Leveldb) checkKeyspace() error {
+	version, err := self.Get(KEYSPACE_KEY)
+	if err != nil {
+		return err
+	}
+	if version != nil {
+		if string(version) != KEYSPACE_VERSION {
+			return fmt.Errorf("unknown keyspace version:%s", version)
+		}
+		return nil
+	}
+
+	it := self.NewIterator()
+	defer it.Close()
+	it.SeekToFirst()
+	if it.Valid() {
+		return errors.New("legacy keyspace, run with -migrate-keyspace first")
+	}
+	if err = it.GetError(); err != nil {
+		return err
+	}
+	return self.Put(KEYSPACE_KEY, []byte(KEYSPACE_VERSION))
+}
+
+// a legacy entry under an internal prefix may be the record of a key which
+// happens to start with it, such a key has an index entry of its own
+func isLegacyRecordKey(db *Leveldb, entry []byte) (bool, error) {
+	version, err := db.Get([]byte(LEGACY_INDEX_PREFIX + string(entry)))
+	return version != nil, err
+}
+
+// keys starting with a byte below '\x02' would stay where the new keyspace lives
+func checkLegacyKeys(db *Leveldb) error {
+	it := db.NewIterator()
+	defer it.Close()
+
+	start := []byte(LEGACY_INDEX_PREFIX)
+	for it.Seek(start); it.Valid() && bytes.HasPrefix(it.Key(), start); it.Next() {
+		record, err := isLegacyRecordKey(db, it.Key())
+		if err != nil {
+			return err
+		}
+		if record {
+			continue
+		}
+		key := it.Key()[len(start):]
+		if len(key) > 0 && key[0] < DATA_KEY_LIMIT[0] {
+			return fmt.Errorf("key %q can't be migrated", key)
+		}
+	}
+	return it.GetError()
+}
+
+// copy records and rebuild their index entries, return the number of records.
+// Records of keys starting with '|' are copied through their own index entry
+func migrateLegacyRecords(db *Leveldb) (count int, err error) {
+	it := db.NewIterator()
+	defer it.Close()
+
+	batch := new(Batch)
+	start := []byte(LEGACY_INDEX_PREFIX)
+	for it.Seek(start); it.Valid() && bytes.HasPrefix(it.Key(), start); it.Next() {
+		var record bool
+		if record, err = isLegacyRecordKey(db, it.Key()); err != nil {
+			return
+		}
+		if record {
+			continue
+		}
+		key := string(it.Key()[len(start):])
+		var chunk []byte
+		if chunk, err = db.Get([]byte(key)); err != nil {
+			return
+		}
+		if chunk == nil {
+			Error("index without data, key:%s", key)
+			continue
+		}
+		var rec *Record
+		if rec, err = decodeRecord(key, chunk); err != nil {
+			Error("decode key:%s failed:%v", key, err)
+			return
+		}
+		batch.Put([]byte(indexKey(key)), it.Value())
+		batch.Put(dataKey(key), chunk)
+		db.indexRecord(batch, nil, rec)
+		count++
+		if count%MIGRATE_BATCH == 0 {
+			if err = db.Write(batch); err != nil {
+				return
+			}
+			batch = new(Batch)
+			Info("migrate keyspace progress:%d", count)
+		}
+	}
+	if err = it.GetError(); err != nil {
+		return
+	}
+	err = db.Write(batch)
+	return
+}
+
+// move entries under a legacy internal prefix into the internal keyspace,
+// skipping records whose key happens to start with it
+func migrateLegacyEntries(db *Leveldb, prefix string) (count int, err error) {
+	it := db.NewIterator()
+	defer it.Close()
+
+	batch := new(Batch)
+	start := []byte(prefix)
+	for it.Seek(start); it.Valid() && bytes.HasPrefix(it.Key(), start); it.Next() {
+		var record bool
+		if record, err = isLegacyRecordKey(db, it.Key()); err != nil {
+			return
+		}
+		if record {
+			continue
+		}
+		batch.Put([]byte(INTERNAL_PREFIX+string(it.Key())), it.Value())
+		count++
+		if count%MIGRATE_BATCH == 0 {
+			if err = db.Write(batch); err != nil {
+				return
+			}
+			batch = new(Batch)
+		}
+	}
+	if err = it.GetError(); err != nil {
+		return
+	}
+	err = db.Write(batch)
+	return
+}
+
+// delete everything outside the new keyspace
+func deleteLegacyKeys(db *Leveldb) (count int, err error) {
+	it := db.NewIterator()
+	defer it.Close()
+
+	batch := new(Batch)
+	for it.Seek(DATA_KEY_LIMIT); it.Valid(); it.Next() {
+		batch.Delete(it.Key())
+		count++
+		if count%MIGRATE_BATCH == 0 {
+			if err = db.Write(batch); err != nil {
+				return
+			}
+			batch = new(Batch)
+		}
+	}
+	if err = it.GetError(); err != nil {
+		return
+	}
+	err = db.Write(batch)
+	return
+}
+
+// rewrite a legacy database into the current keyspace, must be called while
+// the database is not opened. It can be run again if it's interrupted
+func MigrateKeyspace(config *LeveldbConfig) (err error) {
+	options, env, cache, filter := newOptions(config)
+	db := &Leveldb{
+		env:      env,
+		cache:    cache,
+		filter:   filter,
+		options:  options,
+		roptions: levigo.NewReadOptions(),
+		woptions: levigo.NewWriteOptions(),
+		indexes:  config.Indexes,
+	}
+	defer db.Close()
+	if err = db.Open(config.Dbname); err != nil {
+		return
+	}
+
+	version, err := db.Get(KEYSPACE_KEY)
+	if err != nil {
+		return
+	}
+	if version != nil {
+		Info("keyspace is already at version %s", version)
+		return
+	}
+
+	if err = checkLegacyKeys(db); err != nil {
+		return
+	}
+	records, err := migrateLegacyRecords(db)
+	if err != nil {
+		return
+	}
+	changes, err := migrateLegacyEntries(db, LEGACY_CHANGE_PREFIX)
+	if err != nil {
+		return
+	}
+	sinks, err := migrateLegacyEntries(db, LEGACY_SINK_PREFIX)
+	if err != nil {
+		return
+	}
+	deleted, err := deleteLegacyKeys(db)
+	if err != nil {
+		return
+	}
+	if err = db.Put(KEYSPACE_KEY, []byte(KEYSPACE_VERSION)); err != nil {
+		return
+	}
+	db.Compact(nil, nil)
+	Info("migrate keyspace finish, records:%d, changes:%d, sink entries:%d, deleted:%d",
+		records, changes, sinks, deleted)
+	return
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"levigo"
+)
+
+// write entries the way old versions laid them out, bypassing checkKeyspace
+func writeLegacyLeveldb(t *testing.T, config *LeveldbConfig, entries map[string]string) {
+	options, env, cache, filter := newOptions(config)
+	db := &Leveldb{
+		env:      env,
+		cache:    cache,
+		filter:   filter,
+		options:  options,
+		roptions: levigo.NewReadOptions(),
+		woptions: levigo.NewWriteOptions(),
+	}
+	defer db.Close()
+	if err := db.Open(config.Dbname); err != nil {
+		t.Fatalf("open legacy db failed:%v", err)
+	}
+	batch := new(Batch)
+	for key, value := range entries {
+		batch.Put([]byte(key), []byte(value))
+	}
+	if err := db.Write(batch); err != nil {
+		t.Fatalf("write legacy db failed:%v", err)
+	}
+}
+
+func TestMigrateKeyspace(t *testing.T) {
+	config := &LeveldbConfig{Dbname: filepath.Join(t.TempDir(), "db"), Indexes: []string{"name"}}
+	if err := config.setDefault(); err != nil {
+		t.Fatalf("invalid leveldb config:%v", err)
+	}
+
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, 1)
+	writeLegacyLeveldb(t, config, map[string]string{
+		// records whose keys start with the legacy internal prefixes
+		"uid:1":    `{"version":"1","name":"plain"}`,
+		"|pipe":    `{"version":"2","name":"pipe"}`,
+		"$dollar":  `{"version":"3","name":"dollar"}`,
+		"%pct":     `{"version":"4","name":"pct"}`,
+		"|uid:1":   "1",
+		"||pipe":   "2",
+		"|$dollar": "3",
+		"|%pct":    "4",
+		// internal entries
+		LEGACY_CHANGE_PREFIX + string(seq):   "change",
+		LEGACY_SINK_PREFIX + "out\x00cursor": "1",
+		"#name\x00plain\x00uid:1":            "",
+	})
+
+	if err := MigrateKeyspace(config); err != nil {
+		t.Fatalf("migrate keyspace failed:%v", err)
+	}
+	db := NewLeveldb(config)
+	defer db.Close()
+
+	for key, name := range map[string]string{"uid:1": "plain", "|pipe": "pipe", "$dollar": "dollar", "%pct": "pct"} {
+		rec, err := db.GetRecord(key)
+		if err != nil || rec == nil || rec.Fields["name"] != name {
+			t.Errorf("record %q lost, rec:%v, err:%v", key, rec, err)
+		}
+		if keys, _ := db.Find("name", name, 10); len(keys) != 1 || keys[0] != key {
+			t.Errorf("field index of %q not rebuilt, keys:%v", key, keys)
+		}
+	}
+	if rec, _ := db.GetRecord("pipe"); rec != nil {
+		t.Errorf("bogus record for the index of |pipe")
+	}
+	if n := countPrefix(db, INDEX_KEY_START); n != 4 {
+		t.Errorf("%d index entries, expect 4", n)
+	}
+	if n := countPrefix(db, DATA_KEY_START); n != 4 {
+		t.Errorf("%d records, expect 4", n)
+	}
+	if n := countPrefix(db, CHANGE_KEY_START); n != 1 {
+		t.Errorf("%d change entries, expect 1", n)
+	}
+	if n := countPrefix(db, []byte(SINK_KEY_PREFIX)); n != 1 {
+		t.Errorf("%d sink entries, expect 1", n)
+	}
+
+	it := db.NewIterator()
+	defer it.Close()
+	if it.Seek(DATA_KEY_LIMIT); it.Valid() {
+		t.Errorf("legacy entry %q left", it.Key())
+	}
+}
+
+func TestMigrateKeyspaceRefusesInternalKeys(t *testing.T) {
+	config := &LeveldbConfig{Dbname: filepath.Join(t.TempDir(), "db")}
+	if err := config.setDefault(); err != nil {
+		t.Fatalf("invalid leveldb config:%v", err)
+	}
+	writeLegacyLeveldb(t, config, map[string]string{
+		"\x01key":  `{"version":"1"}`,
+		"|\x01key": "1",
+	})
+	if err := MigrateKeyspace(config); err == nil {
+		t.Errorf("key below the new keyspace migrated")
+	}
+}
@@ -1,16 +1,36 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"levigo"
+	"sync"
 )
 
+const KEY_LOCK_NUM int = 64
+
 type Leveldb struct {
 	env      *levigo.Env
+	cache    *levigo.Cache
+	filter   *levigo.FilterPolicy
 	options  *levigo.Options
 	roptions *levigo.ReadOptions
 	woptions *levigo.WriteOptions
 	db       *levigo.DB
+	locks    [KEY_LOCK_NUM]sync.Mutex
+
+	durability   string
+	syncWoptions *levigo.WriteOptions
+	syncWrite    func(wb *levigo.WriteBatch) error // writeSynced, tests inject failures
+	commits      chan *commitReq
+	syncStats    SyncStats
+	conflicts    ConflictStats
+	quit         chan bool
+	wg           sync.WaitGroup
+
+	indexes []string
+	changes *ChangeHub
+	sinks   *SinkMgr
 }
 
 func (self *Leveldb) Open(dbname string) (err error) {
@@ -28,23 +48,82 @@ func (self *Leveldb) BatchPut(args ...[]byte) error {
 		return errors.New("illegal parameters")
 	}
 
-	batch := levigo.NewWriteBatch()
-	defer batch.Close()
-
+	batch := new(Batch)
 	for i := 0; i < sz-1; i = i + 2 {
 		batch.Put(args[i], args[i+1])
 	}
-	return self.db.Write(self.woptions, batch)
+	return self.Write(batch)
 }
 
 func (self *Leveldb) Put(key, value []byte) error {
-	return self.db.Put(self.woptions, key, value)
+	return self.BatchPut(key, value)
 }
 
 func (self *Leveldb) Get(key []byte) ([]byte, error) {
 	return self.db.Get(self.roptions, key)
 }
 
+// serialize read-modify-write on the same key
+func (self *Leveldb) Lock(key string) *sync.Mutex {
+	l := &self.locks[_hash(key)%KEY_LOCK_NUM]
+	l.Lock()
+	return l
+}
+
+// return nil if key doesn't exist
+func (self *Leveldb) GetRecord(key string) (rec *Record, err error) {
+	chunk, err := self.Get(dataKey(key))
+	if chunk == nil || err != nil {
+		return
+	}
+	return decodeRecord(key, chunk)
+}
+
+func (self *Leveldb) PutRecord(rec *Record) error {
+	l := self.Lock(rec.Key)
+	defer l.Unlock()
+	return self.putRecord(rec)
+}
+
+// caller must hold the key lock
+func (self *Leveldb) putRecord(rec *Record) error {
+	batch := new(Batch)
+	var old *Record
+	if len(self.indexes) > 0 || self.changes != nil {
+		var err error
+		if old, err = self.GetRecord(rec.Key); err != nil {
+			return err
+		}
+	}
+	self.indexRecord(batch, old, rec)
+	batch.Put([]byte(indexKey(rec.Key)), []byte(rec.Version))
+	batch.Put(dataKey(rec.Key), encodeRecord(rec))
+	if self.sinks != nil {
+		self.sinks.Enqueue(batch, rec)
+		defer self.sinks.Notify()
+	}
+	if self.changes == nil {
+		return self.Write(batch)
+	}
+
+	ev := &ChangeEvent{
+		Seq:       self.changes.Allocate(),
+		Key:       rec.Key,
+		Version:   rec.Version,
+		Timestamp: rec.Timestamp,
+		Fields:    changedFields(old, rec),
+	}
+	chunk, _ := json.Marshal(ev)
+	batch.Put(changeKey(ev.Seq), chunk)
+	err := self.Write(batch)
+	if err != nil {
+		self.changes.Commit(ev.Seq, nil)
+	} else {
+		self.changes.Commit(ev.Seq, ev)
+	}
+	return err
+}
+
 func (self *Leveldb) Info(key string) string {
 	property := "leveldb." + key
 	prop := self.db.PropertyValue(property)
@@ -55,6 +134,8 @@ func (self *Leveldb) Info(key string) string {
 }
 
 func (self *Leveldb) Close() {
+	self.stopDurability()
+
 	if self.db != nil {
 		self.db.Close()
 	}
@@ -63,6 +144,26 @@ func (self *Leveldb) Close() {
 		self.options.Close()
 	}
 
+	if self.roptions != nil {
+		self.roptions.Close()
+	}
+
+	if self.woptions != nil {
+		self.woptions.Close()
+	}
+
+	if self.syncWoptions != nil {
+		self.syncWoptions.Close()
+	}
+
+	if self.cache != nil {
+		self.cache.Close()
+	}
+
+	if self.filter != nil {
+		self.filter.Close()
+	}
+
 	if self.env != nil {
 		self.env.Close()
 	}
@@ -72,7 +173,7 @@ func (self *Leveldb) NewIterator() *levigo.Iterator {
 	return self.db.NewIterator(self.roptions)
 }
 
-func NewLeveldb(name string) *Leveldb {
+func newOptions(config *LeveldbConfig) (*levigo.Options, *levigo.Env, *levigo.Cache, *levigo.FilterPolicy) {
 	options := levigo.NewOptions()
 
 	// options.SetComparator(cmp)
@@ -84,38 +185,85 @@ func NewLeveldb(name string) *Leveldb {
 	options.SetEnv(env)
 
 	// set cache
-	cache := levigo.NewLRUCache(16 << 20)
+	cache := levigo.NewLRUCache(config.CacheSize << 20)
 	options.SetCache(cache)
 
 	options.SetInfoLog(nil)
-	options.SetParanoidChecks(false)
-	options.SetWriteBufferSize(128 << 20)
-	options.SetMaxOpenFiles(2000)
-	options.SetBlockSize(4 * 1024)
-	options.SetBlockRestartInterval(16)
-	options.SetCompression(levigo.SnappyCompression)
+	options.SetParanoidChecks(config.ParanoidChecks)
+	options.SetWriteBufferSize(config.WriteBufferSize << 20)
+	options.SetMaxOpenFiles(config.MaxOpenFiles)
+	options.SetBlockSize(config.BlockSize)
+	options.SetBlockRestartInterval(config.BlockRestartInterval)
+	// validated by setDefault
+	if config.Compression == "none" {
+		options.SetCompression(levigo.NoCompression)
+	} else {
+		options.SetCompression(levigo.SnappyCompression)
+	}
 
 	// set filter
-	filter := levigo.NewBloomFilter(10)
-	options.SetFilterPolicy(filter)
+	var filter *levigo.FilterPolicy
+	if config.BloomBits > 0 {
+		filter = levigo.NewBloomFilter(config.BloomBits)
+		options.SetFilterPolicy(filter)
+	}
+	return options, env, cache, filter
+}
+
+func (self *Leveldb) Compact(start, limit []byte) {
+	self.db.CompactRange(levigo.Range{Start: start, Limit: limit})
+}
+
+func (self *Leveldb) Sizes(ranges []levigo.Range) []uint64 {
+	return self.db.GetApproximateSizes(ranges)
+}
+
+func NewLeveldb(config *LeveldbConfig) *Leveldb {
+	options, env, cache, filter := newOptions(config)
 
 	roptions := levigo.NewReadOptions()
-	roptions.SetVerifyChecksums(false)
+	roptions.SetVerifyChecksums(config.VerifyChecksums)
 	roptions.SetFillCache(true)
 
 	woptions := levigo.NewWriteOptions()
-	// set sync false
 	woptions.SetSync(false)
 
-	db := &Leveldb{env,
-		options,
-		roptions,
-		woptions,
-		nil}
-	if err := db.Open(name); err != nil {
+	syncWoptions := levigo.NewWriteOptions()
+	syncWoptions.SetSync(true)
+
+	db := &Leveldb{
+		env:          env,
+		cache:        cache,
+		filter:       filter,
+		options:      options,
+		roptions:     roptions,
+		woptions:     woptions,
+		syncWoptions: syncWoptions,
+		indexes:      config.Indexes,
+	}
+	if err := db.Open(config.Dbname); err != nil {
 		Panic("open db failed, err:%v", err)
 	} else {
-		Info("open db succeed, dbname:%v", name)
+		Info("open db succeed, dbname:%v", config.Dbname)
+	}
+	if err := db.checkKeyspace(); err != nil {
+		Panic("check keyspace failed, err:%v", err)
 	}
+	db.startDurability(config)
+	db.startChangeLog(config)
 	return db
 }
+
+// must be called while the database is not opened
+func RepairLeveldb(config *LeveldbConfig) error {
+	options, env, cache, filter := newOptions(config)
+	defer func() {
+		options.Close()
+		cache.Close()
+		env.Close()
+		if filter != nil {
+			filter.Close()
+		}
+	}()
+	return levigo.RepairDatabase(config.Dbname, options)
+}
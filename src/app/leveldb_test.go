@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// open a leveldb in a temporary directory, closed when the test ends
+func newTestLeveldb(t *testing.T, config *LeveldbConfig) *Leveldb {
+	if config == nil {
+		config = &LeveldbConfig{}
+	}
+	config.Dbname = filepath.Join(t.TempDir(), "db")
+	if err := config.setDefault(); err != nil {
+		t.Fatalf("invalid leveldb config:%v", err)
+	}
+	db := NewLeveldb(config)
+	t.Cleanup(db.Close)
+	return db
+}
+
+// number of leveldb entries starting with prefix
+func countPrefix(db *Leveldb, prefix []byte) int {
+	it := db.NewIterator()
+	defer it.Close()
+	count := 0
+	for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		count++
+	}
+	return count
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"redis"
+)
+
+// write fields back only if the key is still absent, ARGV[1] is ttl in ms
+const LOAD_SCRIPT string = `
+if redis.call('exists', KEYS[1]) == 1 then
+	return 0
+end
+` + HMSET_ARGV + `
+local pttl = tonumber(ARGV[1])
+if pttl > 0 then
+	redis.call('pexpire', KEYS[1], pttl)
+end
+return 1
+`
+
+type RedisPool struct {
+	config *Redis
+	conns  chan *redis.Redis
+}
+
+func (p *RedisPool) Get() (cli *redis.Redis, err error) {
+	select {
+	case cli = <-p.conns:
+		return
+	default:
+		return p.config.Connect()
+	}
+}
+
+// broken connections should be closed instead of put back
+func (p *RedisPool) Put(cli *redis.Redis) {
+	select {
+	case p.conns <- cli:
+	default:
+		cli.Close()
+	}
+}
+
+func NewRedisPool(config *Redis, size int) *RedisPool {
+	return &RedisPool{config, make(chan *redis.Redis, size)}
+}
+
+// read-through loader, warm redis from leveldb on miss
+type Loader struct {
+	db     *Leveldb
+	config *Redis
+	pool   *RedisPool
+}
+
+// return the data in redis after loading, nil if key doesn't exist anywhere
+func (l *Loader) Load(key string, ttl int) (data map[string]string, loaded bool, err error) {
+	cli, err := l.pool.Get()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			cli.Close()
+		} else {
+			l.pool.Put(cli)
+		}
+	}()
+	loaded, err = load(l.db, key, ttl, cli)
+	if err != nil {
+		return
+	}
+
+	data = make(map[string]string)
+	if err = cli.Hgetall(key, data); err != nil {
+		return
+	}
+	if len(data) == 0 {
+		data = nil
+	}
+	return
+}
+
+func NewLoader(db *Leveldb, config *Redis) *Loader {
+	return &Loader{db, config, NewRedisPool(config, 8)}
+}
+
+func handlerLoad(ud interface{}, params interface{}) (result interface{}, err error) {
+	src := ud.(*Source)
+	key := ""
+	ttl := src.config.LoadTtl
+	switch args := params.(type) {
+	case string:
+		key = args
+	case map[string]interface{}:
+		key, _ = args["key"].(string)
+		if n, ok := args["ttl"].(float64); ok {
+			ttl = int(n)
+		}
+	}
+	if key == "" {
+		err = invalidParams("no key")
+		return
+	}
+
+	Info("agent load:%v, ttl:%d", key, ttl)
+	data, loaded, err := src.loader.Load(key, ttl)
+	if err != nil {
+		Error("load key:%s failed:%v", key, err)
+		return
+	}
+	if loaded {
+		Info("load key:%s into redis", key)
+	}
+	result = data
+	return
+}
+
+// load key [ttl]
+func respLoad(ud interface{}, w *RespWriter, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return WrongArgs("load")
+	}
+	loader := ud.(*Loader)
+	ttl := loader.config.LoadTtl
+	if len(args) > 1 {
+		var err error
+		if ttl, err = strconv.Atoi(args[1]); err != nil {
+			return errors.New("value is not an integer or out of range")
+		}
+	}
+
+	data, _, err := loader.Load(args[0], ttl)
+	if err != nil {
+		return err
+	}
+	w.ArrayHeader(len(data) * 2)
+	for k, v := range data {
+		w.Bulk(k)
+		w.Bulk(v)
+	}
+	return nil
+}
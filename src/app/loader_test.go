@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func startTestLoader(t *testing.T) (*Loader, *fakeRedis) {
+	setVersion(t, VersionConfig{})
+	r := startFakeRedis(t)
+	l := NewLoader(newTestLeveldb(t, nil), &Redis{Host: r.Addr()})
+	t.Cleanup(func() {
+		close(l.pool.conns)
+		for cli := range l.pool.conns {
+			cli.Close()
+		}
+	})
+	return l, r
+}
+
+func TestLoaderLoad(t *testing.T) {
+	setNamespaces(t, []NamespaceConfig{{Name: "secret", Pattern: "secret:*", Fields: FieldRules{Redact: []string{"token"}}}})
+	l, r := startTestLoader(t)
+	putFields(t, l.db, "uid:1", map[string]string{"version": "1", "name": "a"})
+	putFields(t, l.db, "uid:2", map[string]string{"version": "1", "name": "b"})
+	r.Hset("uid:2", map[string]string{"version": "2", "name": "redis"})
+	expired := &Record{Key: "uid:3", Version: "1", Fields: map[string]string{"version": "1"}, ExpireAt: nowMs() - 1000}
+	if err := l.db.PutRecord(expired); err != nil {
+		t.Fatalf("put record failed:%v", err)
+	}
+	// nothing leveldb can restore
+	putFields(t, l.db, "secret:1", map[string]string{"token": "t"})
+
+	cases := []struct {
+		key    string
+		loaded bool
+		name   string
+	}{
+		{"uid:1", true, "a"},
+		{"uid:1", false, "a"},
+		{"uid:2", false, "redis"},
+		{"uid:3", false, ""},
+		{"secret:1", false, ""},
+		{"uid:404", false, ""},
+	}
+	for _, c := range cases {
+		data, loaded, err := l.Load(c.key, 0)
+		if err != nil {
+			t.Fatalf("load %s failed:%v", c.key, err)
+		}
+		if loaded != c.loaded || data["name"] != c.name {
+			t.Errorf("load %s, loaded:%v, data:%v", c.key, loaded, data)
+		}
+		if c.name == "" && data != nil {
+			t.Errorf("load %s, expect nil, got %v", c.key, data)
+		}
+	}
+	if r.Pttl("uid:1") != -1 {
+		t.Errorf("loaded without ttl expires")
+	}
+}
+
+func TestLoaderTtl(t *testing.T) {
+	l, r := startTestLoader(t)
+	putFields(t, l.db, "uid:1", map[string]string{"version": "1"})
+	volatile := &Record{Key: "uid:2", Version: "1", Fields: map[string]string{"version": "1"}, ExpireAt: nowMs() + 5000}
+	if err := l.db.PutRecord(volatile); err != nil {
+		t.Fatalf("put record failed:%v", err)
+	}
+
+	for _, key := range []string{"uid:1", "uid:2"} {
+		if _, loaded, err := l.Load(key, 60); err != nil || !loaded {
+			t.Fatalf("load %s failed, loaded:%v, err:%v", key, loaded, err)
+		}
+	}
+	if pttl := r.Pttl("uid:1"); pttl <= 5000 || pttl > 60000 {
+		t.Errorf("pttl %d, expect the load ttl", pttl)
+	}
+	// the persisted ttl caps the load ttl
+	if pttl := r.Pttl("uid:2"); pttl <= 0 || pttl > 5000 {
+		t.Errorf("pttl %d, expect the persisted ttl", pttl)
+	}
+}
+
+func TestLoaderLarge(t *testing.T) {
+	l, r := startTestLoader(t)
+	fields := map[string]string{"version": "1"}
+	for i := 0; i < LUA_MAX_UNPACK; i++ {
+		fields[fmt.Sprintf("f%d", i)] = "v"
+	}
+	putFields(t, l.db, "big", fields)
+	data, loaded, err := l.Load("big", 0)
+	if err != nil || !loaded || len(data) != len(fields) {
+		t.Errorf("load big hash, loaded:%v, fields:%d, err:%v", loaded, len(data), err)
+	}
+	if r.Pttl("big") != -1 {
+		t.Errorf("big hash not loaded")
+	}
+}
+
+func TestRedisPool(t *testing.T) {
+	r := startFakeRedis(t)
+	p := NewRedisPool(&Redis{Host: r.Addr()}, 1)
+	a, err := p.Get()
+	if err != nil {
+		t.Fatalf("get failed:%v", err)
+	}
+	b, err := p.Get()
+	if err != nil {
+		t.Fatalf("get failed:%v", err)
+	}
+	if a == b {
+		t.Fatalf("same connection handed out twice")
+	}
+	p.Put(a)
+	// over the pool size, closed
+	p.Put(b)
+	if n := len(p.conns); n != 1 {
+		t.Errorf("%d pooled connections, expect 1", n)
+	}
+	if c, _ := p.Get(); c != a {
+		t.Errorf("pooled connection not reused")
+	}
+	a.Close()
+}
@@ -10,14 +10,15 @@ import (
 	"syscall"
 )
 
+// Context of manager commands, on the source selected by the connection
 type Context struct {
-	db         *Leveldb
-	m          *Monitor
-	s          *StorerMgr
-	c          *CmdService
-	agent      *AgentSvr
-	quit_chan  chan bool
-	sync_queue chan string
+	*Source
+	sources   []*Source // the first one is the default
+	c         *CmdService
+	agent     *AgentSvr
+	resp      *RespSvr
+	http      *HttpSvr
+	quit_chan chan bool
 }
 
 type Redis struct {
@@ -27,14 +28,70 @@ type Redis struct {
 	NotificationConfig string
 	Event              string
 	Expire             bool
+	LoadTtl            int    // seconds, default ttl for keys loaded back from leveldb
+	Capture            string // notification (default), stream or poll
+	Stream             StreamConfig
+	Poll               PollConfig
+	Replicas           []string // optional, storers read keys from replicas
+	ReplicaRetry       int      // times to read a lagging replica again before the primary, default 3
+	ReplicaWait        int      // ms between replica reads, default 50
 }
 
 type LeveldbConfig struct {
-	Dbname string
+	Dbname               string
+	CacheSize            int // MB
+	WriteBufferSize      int // MB
+	MaxOpenFiles         int
+	BlockSize            int
+	BlockRestartInterval int
+	BloomBits            int // 0: default, < 0: disable bloom filter
+	Compression          string
+	ParanoidChecks       bool
+	VerifyChecksums      bool
+	Durability           string // none, periodic or sync
+	SyncInterval         int    // ms, for periodic durability
+	Indexes              []string
+	ChangeLog            int // number of change events to keep, 0 disables change log
+}
+
+func (c *LeveldbConfig) setDefault() error {
+	if c.CacheSize <= 0 {
+		c.CacheSize = 16
+	}
+	if c.WriteBufferSize <= 0 {
+		c.WriteBufferSize = 128
+	}
+	if c.MaxOpenFiles <= 0 {
+		c.MaxOpenFiles = 2000
+	}
+	if c.BlockSize <= 0 {
+		c.BlockSize = 4 * 1024
+	}
+	if c.BlockRestartInterval <= 0 {
+		c.BlockRestartInterval = 16
+	}
+	if c.BloomBits == 0 {
+		c.BloomBits = 10
+	}
+	switch c.Compression {
+	case "":
+		c.Compression = "snappy"
+	case "snappy", "none":
+	default:
+		return fmt.Errorf("unknown compression %s", c.Compression)
+	}
+	if c.Durability == "" {
+		c.Durability = DURABILITY_NONE
+	}
+	if c.SyncInterval <= 0 {
+		c.SyncInterval = 1000
+	}
+	return nil
 }
 
 type Manager struct {
 	Addr string
+	Tls  TlsConfig
 }
 
 type Log struct {
@@ -43,19 +100,47 @@ type Log struct {
 }
 
 type Agent struct {
+	Addr        string
+	HttpAddr    string // optional, json-rpc over http post
+	MaxInflight int    // max in-flight requests per connection
+	MaxFrame    int    // max bytes of a request frame
+	Tls         TlsConfig
+}
+
+// optional, disabled if addr is empty
+type Resp struct {
+	Addr string
+	Tls  TlsConfig
+}
+
+// optional, disabled if addr is empty
+type Http struct {
 	Addr string
+	Tls  TlsConfig
 }
 
 type Setting struct {
-	Redis   Redis
-	Leveldb LeveldbConfig
-	Manager Manager
-	Log     Log
-	Agent   Agent
+	Redis      Redis
+	Leveldb    LeveldbConfig
+	Manager    Manager
+	Log        Log
+	Agent      Agent
+	Resp       Resp
+	Http       Http
+	Sinks      []SinkConfig
+	Auth       AuthConfig
+	Evict      EvictConfig
+	Version    VersionConfig
+	Restore    RestoreConfig
+	Namespaces []NamespaceConfig
+	Sources    []SourceConfig // optional, replace redis, leveldb.dbname and sinks
 }
 
+var repair = flag.Bool("repair", false, "repair leveldb and exit")
+var migrateKeyspace = flag.Bool("migrate-keyspace", false, "migrate a legacy leveldb to the current keyspace and exit")
+
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: %s [config]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s [-repair] [-migrate-keyspace] [config]\n", os.Args[0])
 	flag.PrintDefaults()
 	os.Exit(2)
 }
@@ -65,10 +150,17 @@ func safeQuit(context *Context) {
 	Error("wait context")
 	context.agent.Stop()
 	Error("wait agent")
-	context.m.Stop()
-	Error("wait monitor")
-	context.s.Stop()
-	Error("wait storer")
+	if context.resp != nil {
+		context.resp.Stop()
+		Error("wait resp")
+	}
+	if context.http != nil {
+		context.http.Stop()
+		Error("wait http")
+	}
+	for _, src := range context.sources {
+		src.Stop()
+	}
 	context.quit_chan <- true
 }
 
@@ -105,32 +197,95 @@ func main() {
 	if err = json.Unmarshal([]byte(content), &setting); err != nil {
 		panic(err)
 	}
+	if setting.Agent.MaxInflight <= 0 {
+		setting.Agent.MaxInflight = 64
+	}
+	if setting.Agent.MaxFrame <= 0 {
+		setting.Agent.MaxFrame = AGENT_MAX_FRAME
+	}
 
 	// init log
 	initLog()
 
-	database := NewLeveldb(setting.Leveldb.Dbname)
-	defer database.Close()
+	if err = setting.Leveldb.setDefault(); err != nil {
+		Error("invalid leveldb config:%v", err)
+		os.Exit(1)
+	}
+	if err = setting.Auth.setDefault(); err != nil {
+		Error("invalid auth config:%v", err)
+		os.Exit(1)
+	}
+	if err = setting.Version.setDefault(); err != nil {
+		Error("invalid version config:%v", err)
+		os.Exit(1)
+	}
+	if setting.Namespaces, err = setupNamespaces(setting.Namespaces); err != nil {
+		Error("invalid namespace config:%v", err)
+		os.Exit(1)
+	}
+	if setting.Sources, err = setupSources(setting.Sources); err != nil {
+		Error("invalid source config:%v", err)
+		os.Exit(1)
+	}
+	if *repair {
+		for i := range setting.Sources {
+			config := setting.Sources[i].leveldbConfig()
+			if err = RepairLeveldb(config); err != nil {
+				Error("repair db %s failed:%v", config.Dbname, err)
+				os.Exit(1)
+			}
+			Error("repair db %s succeed", config.Dbname)
+		}
+		return
+	}
+	if *migrateKeyspace {
+		for i := range setting.Sources {
+			config := setting.Sources[i].leveldbConfig()
+			if err = MigrateKeyspace(config); err != nil {
+				Error("migrate keyspace of db %s failed:%v", config.Dbname, err)
+				os.Exit(1)
+			}
+			Error("migrate keyspace of db %s succeed", config.Dbname)
+		}
+		return
+	}
 
-	m := NewMonitor()
-	s := NewStorerMgr(database, 5)
+	context := NewContext()
+	for i := range setting.Sources {
+		src := NewSource(&setting.Sources[i])
+		defer src.Close()
+		context.sources = append(context.sources, src)
+	}
+	context.Source = context.sources[0]
 	c := NewCmdService()
-	agent := NewAgent(database)
+	agent := NewAgent(context.sources)
 
-	context := NewContext()
-	context.db = database
-	context.m = m
-	context.s = s
 	context.c = c
 	context.agent = agent
+	if setting.Resp.Addr != "" {
+		context.resp = NewRespSvr(context.db, context.loader)
+	}
+	if setting.Http.Addr != "" {
+		context.http = NewHttpSvr(context)
+	}
 	context.Register(c)
-	context.sync_queue = make(chan string, 1)
+	for _, src := range context.sources {
+		c.RegisterSource(src.name, context.withSource(src.name))
+	}
 
 	go handleSignal(context)
-	go m.Start(context.sync_queue)
-	go s.Start(context.sync_queue)
+	for _, src := range context.sources {
+		src.Start()
+	}
 	go c.Start()
 	go agent.Start()
+	go agent.StartHttp()
+	if context.resp != nil {
+		go context.resp.Start()
+	}
+	if context.http != nil {
+		go context.http.Start()
+	}
 
 	Info("start succeed")
 	Error("catch signal %v, program will exit", <-context.quit_chan)
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// conf/example.json shows every option, keep it loadable
+func TestExampleConfig(t *testing.T) {
+	fp, err := os.Open("../../conf/example.json")
+	if err != nil {
+		t.Fatalf("open example failed:%v", err)
+	}
+	defer fp.Close()
+	var s Setting
+	decoder := json.NewDecoder(fp)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&s); err != nil {
+		t.Fatalf("decode example failed:%v", err)
+	}
+
+	old := setting
+	setting = s
+	t.Cleanup(func() { setting = old })
+	if err = setting.Leveldb.setDefault(); err != nil {
+		t.Errorf("invalid leveldb config:%v", err)
+	}
+	if err = setting.Version.setDefault(); err != nil {
+		t.Errorf("invalid version config:%v", err)
+	}
+	if _, err = setupNamespaces(setting.Namespaces); err != nil {
+		t.Errorf("invalid namespace config:%v", err)
+	}
+	if _, err = setupSources(setting.Sources); err != nil {
+		t.Errorf("invalid source config:%v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// rewrite old json records into the binary format in background
+type Migrator struct {
+	db       *Leveldb
+	mu       sync.Mutex
+	running  bool
+	scanned  int
+	migrated int
+	failed   int
+	err      error
+	quit     chan bool
+	wg       sync.WaitGroup
+}
+
+func (m *Migrator) migrateOne(key string) (migrated bool, err error) {
+	l := m.db.Lock(key)
+	defer l.Unlock()
+
+	chunk, err := m.db.Get(dataKey(key))
+	if chunk == nil || err != nil || !isLegacyRecord(chunk) {
+		return
+	}
+	rec, err := decodeRecord(key, chunk)
+	if err != nil {
+		return
+	}
+	// only the encoding changes, so the version, field indexes, changelog
+	// and sinks are left alone
+	if err = m.db.Put(dataKey(key), encodeRecord(rec)); err != nil {
+		return
+	}
+	migrated = true
+	return
+}
+
+func (m *Migrator) run() {
+	defer m.wg.Done()
+	Info("start migrate records")
+	it := m.db.NewIterator()
+	defer it.Close()
+
+	stopped := false
+	for it.Seek(INDEX_KEY_START); it.Valid() && bytes.Compare(it.Key(), INDEX_KEY_END) <= 0; it.Next() {
+		select {
+		case <-m.quit:
+			stopped = true
+		default:
+		}
+		if stopped {
+			break
+		}
+		key := string(it.Key()[INDEX_KEY_LEN:])
+		migrated, err := m.migrateOne(key)
+
+		m.mu.Lock()
+		m.scanned++
+		if err != nil {
+			Error("migrate key:%s failed:%v", key, err)
+			m.failed++
+		} else if migrated {
+			m.migrated++
+		}
+		if m.scanned%1000 == 0 {
+			Info("migrate progress:%d, migrated:%d, failed:%d", m.scanned, m.migrated, m.failed)
+		}
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	m.err = it.GetError()
+	m.running = false
+	if stopped {
+		Info("migrate stopped, scanned:%d, migrated:%d, failed:%d", m.scanned, m.migrated, m.failed)
+	} else {
+		Info("migrate finish, scanned:%d, migrated:%d, failed:%d, err:%v", m.scanned, m.migrated, m.failed, m.err)
+	}
+	m.mu.Unlock()
+}
+
+func (m *Migrator) Start() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running {
+		return false
+	}
+	select {
+	case <-m.quit:
+		return false
+	default:
+	}
+	m.running = true
+	m.scanned, m.migrated, m.failed, m.err = 0, 0, 0, nil
+	m.wg.Add(1)
+	go m.run()
+	return true
+}
+
+// interrupt a running migration and wait for it, it can't be started again
+func (m *Migrator) Stop() {
+	m.mu.Lock()
+	close(m.quit)
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+func (m *Migrator) Status() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := "idle"
+	if m.running {
+		state = "running"
+	}
+	return fmt.Sprintf("migrate %s, scanned:%d, migrated:%d, failed:%d, err:%v", state, m.scanned, m.migrated, m.failed, m.err)
+}
+
+func NewMigrator(db *Leveldb) *Migrator {
+	return &Migrator{db: db, quit: make(chan bool)}
+}
+
+// migrate [status]
+func migrate(ud interface{}, args []string) (result string, err error) {
+	context := ud.(*Context)
+	if len(args) > 0 && args[0] == "status" {
+		result = context.migrator.Status()
+		return
+	}
+
+	if !context.migrator.Start() {
+		result = "migrate is already running or stopped\n" + context.migrator.Status()
+		return
+	}
+	result = "migrate started"
+	return
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMigratorBypassesChangeLog(t *testing.T) {
+	db := newTestLeveldb(t, &LeveldbConfig{ChangeLog: 100, Indexes: []string{"name"}})
+	rec := &Record{Key: "uid:1", Version: "3", Fields: map[string]string{"version": "3", "name": "foo"}}
+	if err := db.PutRecord(rec); err != nil {
+		t.Fatalf("put record failed:%v", err)
+	}
+	changes := countPrefix(db, CHANGE_KEY_START)
+
+	// rewrite it the way old versions stored records
+	if err := db.Put(dataKey(rec.Key), []byte(`{"version":"3","name":"foo"}`)); err != nil {
+		t.Fatalf("put legacy record failed:%v", err)
+	}
+	m := NewMigrator(db)
+	migrated, err := m.migrateOne(rec.Key)
+	if err != nil || !migrated {
+		t.Fatalf("migrate failed, migrated:%v, err:%v", migrated, err)
+	}
+
+	chunk, _ := db.Get(dataKey(rec.Key))
+	if isLegacyRecord(chunk) {
+		t.Errorf("record is still json")
+	}
+	if n := countPrefix(db, CHANGE_KEY_START); n != changes {
+		t.Errorf("migration logged %d change events", n-changes)
+	}
+	if seq := db.changes.Committed(); seq != uint64(changes) {
+		t.Errorf("migration allocated seq %d", seq)
+	}
+	if keys, _ := db.Find("name", "foo", 10); len(keys) != 1 {
+		t.Errorf("field index lost, keys:%v", keys)
+	}
+}
+
+func TestMigratorStop(t *testing.T) {
+	db := newTestLeveldb(t, nil)
+	for _, key := range []string{"a", "b", "c"} {
+		db.Put([]byte(indexKey(key)), []byte("1"))
+		db.Put(dataKey(key), []byte(`{"version":"1"}`))
+	}
+	m := NewMigrator(db)
+	if !m.Start() {
+		t.Fatalf("migrator didn't start")
+	}
+	m.Stop()
+	if m.Start() {
+		t.Errorf("migrator started after stop")
+	}
+}
@@ -7,6 +7,14 @@ import (
 	"redis"
 )
 
+// Capture watches redis for dirty keys and feeds them to storers,
+// it closes the queue when it exits
+type Capture interface {
+	Start(queue chan *SyncTask)
+	Stop()
+}
+
+// capture by keyspace notifications, writes during a disconnect are missed
 type Monitor struct {
 	cli                 *redis.Redis
 	notification_config string
@@ -66,7 +74,7 @@ func (m *Monitor) reconnect() bool {
 	return true
 }
 
-func (m *Monitor) Start(queue chan string) {
+func (m *Monitor) Start(queue chan *SyncTask) {
 	err := m.cli.Connect()
 	if err != nil {
 		Panic("start monitor failed:%v", err)
@@ -95,7 +103,7 @@ func (m *Monitor) Start(queue chan string) {
 				event := data[1]
 				key := data[2]
 				Info("receive [%s], value[%s]", event, key)
-				queue <- key
+				queue <- &SyncTask{Key: key}
 
 				qlen := len(queue)
 				if qlen > m.qlen {
@@ -118,9 +126,9 @@ func (m *Monitor) Stop() {
 	<-m.quit_chan
 }
 
-func NewMonitor() *Monitor {
-	cli := redis.NewRedis(setting.Redis.Host, setting.Redis.Password, setting.Redis.Db)
+func NewMonitor(config *Redis) *Monitor {
+	cli := redis.NewRedis(config.Host, config.Password, config.Db)
 	notification_config := "gE"
-	event := fmt.Sprintf("__keyevent@%d__:%s", setting.Redis.Db, setting.Redis.Event)
+	event := fmt.Sprintf("__keyevent@%d__:%s", config.Db, config.Event)
 	return &Monitor{cli, notification_config, event, 0, false, make(chan int)}
 }
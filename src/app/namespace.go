@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	TTL_KEEP   = "keep"   // persist the ttl and apply it on restore
+	TTL_IGNORE = "ignore" // persist volatile keys as permanent ones
+	TTL_SKIP   = "skip"   // never persist volatile keys
+)
+
+// a load ttl would be persisted as the key's own in keep namespaces, and make
+// skip namespaces drop later writes, so they get the persisted ttl only
+func (c *NamespaceConfig) AllowsLoadTtl() bool {
+	return c.Ttl == TTL_IGNORE
+}
+
+// a namespace is a set of keys sharing persistence rules, a key belongs to the
+// first namespace it matches and keys matching none are not persisted
+type NamespaceConfig struct {
+	Name    string
+	Pattern string   // redis glob, e.g. uid:*
+	Types   []string // redis types to persist, default hash, the only supported one
+	Ttl     string   // ignore (default), keep or skip
+	Skip    bool     // never persist matching keys, e.g. caches
+	Fields  FieldRules
+}
+
+func (c *NamespaceConfig) setDefault() error {
+	if c.Name == "" {
+		return errors.New("namespace without name")
+	}
+	if c.Pattern == "" {
+		return fmt.Errorf("namespace %s without pattern", c.Name)
+	}
+	if len(c.Types) == 0 {
+		c.Types = []string{"hash"}
+	}
+	for _, t := range c.Types {
+		if t != "hash" {
+			return fmt.Errorf("namespace %s: type %s can't be persisted", c.Name, t)
+		}
+	}
+	switch c.Ttl {
+	case "":
+		c.Ttl = TTL_IGNORE
+	case TTL_KEEP, TTL_IGNORE, TTL_SKIP:
+	default:
+		return fmt.Errorf("namespace %s: unknown ttl handling %s", c.Name, c.Ttl)
+	}
+	if err := c.Fields.setDefault(); err != nil {
+		return fmt.Errorf("namespace %s: %v", c.Name, err)
+	}
+	return nil
+}
+
+func (c *NamespaceConfig) Match(key string) bool {
+	return matchPattern(c.Pattern, key)
+}
+
+func (c *NamespaceConfig) HasType(name string) bool {
+	for _, t := range c.Types {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// everything goes to one namespace if none is configured
+func setupNamespaces(configs []NamespaceConfig) ([]NamespaceConfig, error) {
+	if len(configs) == 0 {
+		configs = []NamespaceConfig{{Name: "default", Pattern: "*"}}
+	}
+	names := make(map[string]bool)
+	for i := range configs {
+		c := &configs[i]
+		if err := c.setDefault(); err != nil {
+			return nil, err
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate namespace:%s", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return configs, nil
+}
+
+// return nil if key belongs to no namespace
+func namespaceOf(key string) *NamespaceConfig {
+	for i := range setting.Namespaces {
+		if setting.Namespaces[i].Match(key) {
+			return &setting.Namespaces[i]
+		}
+	}
+	return nil
+}
+
+func lookupNamespace(name string) *NamespaceConfig {
+	for i := range setting.Namespaces {
+		if setting.Namespaces[i].Name == name {
+			return &setting.Namespaces[i]
+		}
+	}
+	return nil
+}
+
+func persistable(key string) bool {
+	ns := namespaceOf(key)
+	return ns != nil && !ns.Skip
+}
+
+// redis glob style: * ? [abc] [^a-z] and \ to escape
+func matchPattern(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchPattern(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) > 1:
+					pattern = pattern[1:]
+					match = match || pattern[0] == key[0]
+				case len(pattern) > 2 && pattern[1] == '-':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || (key[0] >= lo && key[0] <= hi)
+					pattern = pattern[2:]
+				default:
+					match = match || pattern[0] == key[0]
+				}
+				pattern = pattern[1:]
+			}
+			if match == not {
+				return false
+			}
+			key = key[1:]
+			if len(pattern) == 0 {
+				// unterminated, like redis
+				return len(key) == 0
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			key = key[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(key) == 0
+}
+
+// namespaces [key]
+func namespaces(ud interface{}, args []string) (result string, err error) {
+	if len(args) > 0 {
+		ns := namespaceOf(args[0])
+		if ns == nil {
+			result = fmt.Sprintf("key:%s matches no namespace, not persisted", args[0])
+		} else {
+			result = fmt.Sprintf("key:%s, namespace:%s, skip:%v", args[0], ns.Name, ns.Skip)
+		}
+		return
+	}
+
+	buf := bytes.NewBufferString("namespaces:\n")
+	for _, ns := range setting.Namespaces {
+		fmt.Fprintf(buf, "%s: pattern:%s, types:%s, ttl:%s, skip:%v\n",
+			ns.Name, ns.Pattern, strings.Join(ns.Types, ","), ns.Ttl, ns.Skip)
+		f := &ns.Fields
+		if len(f.Include)+len(f.Exclude)+len(f.Redact)+len(f.Hash)+len(f.Rename) > 0 {
+			fmt.Fprintf(buf, "\tfields include:%v, exclude:%v, redact:%v, hash:%v, rename:%v\n",
+				f.Include, f.Exclude, f.Redact, f.Hash, f.Rename)
+		}
+	}
+	result = buf.String()
+	return
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"*", "", true},
+		{"*", "uid:1", true},
+		{"uid:*", "uid:1", true},
+		{"uid:*", "gid:1", false},
+		{"*:1", "uid:1", true},
+		{"u**d", "uid", true},
+		{"u*d*", "uxd", true},
+		{"uid:?", "uid:1", true},
+		{"uid:?", "uid:", false},
+		{"uid:?", "uid:12", false},
+		{"uid:[123]", "uid:2", true},
+		{"uid:[123]", "uid:4", false},
+		{"uid:[^123]", "uid:4", true},
+		{"uid:[^123]", "uid:1", false},
+		{"uid:[a-c]", "uid:b", true},
+		{"uid:[c-a]", "uid:b", true},
+		{"uid:[a-c]", "uid:d", false},
+		{"uid:[\\]]", "uid:]", true},
+		{"uid:[]", "uid:1", false},
+		{"uid:\\*", "uid:*", true},
+		{"uid:\\*", "uid:1", false},
+		{"uid:\\?", "uid:?", true},
+		{"uid:[12", "uid:1", true},
+		{"uid:[12", "uid:3", false},
+		{"", "", true},
+		{"", "uid", false},
+	}
+	for _, c := range cases {
+		if match := matchPattern(c.pattern, c.key); match != c.match {
+			t.Errorf("match %q with %q: %v, expect %v", c.pattern, c.key, match, c.match)
+		}
+	}
+}
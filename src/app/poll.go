@@ -0,0 +1,284 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"redis"
+)
+
+const CAPTURE_POLL = "poll"
+
+// move at most ARGV[2] keys from the dirty set KEYS[1] to the processing set
+// KEYS[2], a sorted set is popped in the order of score (modification time).
+// Writes after srandmember need effects replication, the default since redis 5
+const POLL_SCRIPT string = `
+if redis.replicate_commands then
+	redis.replicate_commands()
+end
+local n = tonumber(ARGV[2])
+if ARGV[1] == 'zset' then
+	local items = redis.call('zrange', KEYS[1], 0, n - 1, 'withscores')
+	local keys = {}
+	for i = 1, #items, 2 do
+		redis.call('zadd', KEYS[2], items[i + 1], items[i])
+		redis.call('zrem', KEYS[1], items[i])
+		keys[#keys + 1] = items[i]
+	end
+	return keys
+end
+local keys = redis.call('srandmember', KEYS[1], n)
+for i = 1, #keys, 1000 do
+	local j = math.min(i + 999, #keys)
+	redis.call('sadd', KEYS[2], unpack(keys, i, j))
+	redis.call('srem', KEYS[1], unpack(keys, i, j))
+end
+return keys
+`
+
+// the application adds dirty keys to a set, e.g. SADD dirty uid:1,
+// or a sorted set scored by modification time, e.g. ZADD dirty 1700000000 uid:1
+type PollConfig struct {
+	Name       string
+	Type       string // set (default) or zset
+	Processing string // keys being persisted, default Name + ":processing"
+	Batch      int    // keys per pop, default 100
+	Interval   int    // ms between polls when the set is drained, default 1000
+	Requeue    int    // ms, queue keys which are not persisted for this long again, default 60000
+}
+
+func (c *PollConfig) setDefault() {
+	if c.Type == "" {
+		c.Type = "set"
+	}
+	if c.Processing == "" {
+		c.Processing = c.Name + ":processing"
+	}
+	if c.Batch <= 0 {
+		c.Batch = 100
+	}
+	if c.Interval <= 0 {
+		c.Interval = 1000
+	}
+	if c.Requeue <= 0 {
+		c.Requeue = 60000
+	}
+}
+
+// capture by polling a dirty set, needs no keyspace notifications. Popped keys
+// stay in the processing set until they are persisted, and are queued again
+// if their save fails and after restart
+type PollCapture struct {
+	cli    *redis.Redis
+	config *PollConfig
+	mu     sync.Mutex
+	acks   []interface{}
+	seq    uint64
+	queued map[string]pollDispatch // the last dispatch of a key, only its save acks the key
+	quit   chan bool
+	done   chan bool
+}
+
+type pollDispatch struct {
+	seq uint64
+	at  time.Time
+}
+
+func (pc *PollCapture) ack(key string, seq uint64) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.queued[key].seq != seq {
+		// popped again, wait for the later save
+		return
+	}
+	delete(pc.queued, key)
+	pc.acks = append(pc.acks, key)
+}
+
+// take the acked keys which are not popped again since, a key popped again
+// stays in the processing set until its later save acks it. Pops and flushes
+// run on the same goroutine, so no pop sneaks in before the keys are removed
+func (pc *PollCapture) takeAcks() []interface{} {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	keys := make([]interface{}, 0, len(pc.acks))
+	for _, key := range pc.acks {
+		if _, ok := pc.queued[key.(string)]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	pc.acks = nil
+	return keys
+}
+
+func (pc *PollCapture) flushAcks() error {
+	keys := pc.takeAcks()
+	if len(keys) == 0 {
+		return nil
+	}
+	cmd := "srem"
+	if pc.config.Type == "zset" {
+		cmd = "zrem"
+	}
+	if _, err := pc.cli.Exec(cmd, append([]interface{}{pc.config.Processing}, keys...)...); err != nil {
+		// put them back for the next flush
+		pc.mu.Lock()
+		pc.acks = append(pc.acks, keys...)
+		pc.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (pc *PollCapture) dispatch(queue chan *SyncTask, keys []string) {
+	for _, key := range keys {
+		k := key
+		pc.mu.Lock()
+		pc.seq++
+		seq := pc.seq
+		pc.queued[k] = pollDispatch{seq, time.Now()}
+		pc.mu.Unlock()
+		queue <- &SyncTask{Key: k, Done: func() { pc.ack(k, seq) }}
+	}
+}
+
+// queue keys left in the processing set by the last run
+func (pc *PollCapture) recover(queue chan *SyncTask) error {
+	var resp interface{}
+	var err error
+	if pc.config.Type == "zset" {
+		resp, err = pc.cli.Exec("zrange", pc.config.Processing, 0, -1)
+	} else {
+		resp, err = pc.cli.Exec("smembers", pc.config.Processing)
+	}
+	if err != nil {
+		return err
+	}
+	keys, _ := resp.([]string)
+	if len(keys) > 0 {
+		Info("recover %d keys from %s", len(keys), pc.config.Processing)
+		pc.dispatch(queue, keys)
+	}
+	return nil
+}
+
+// queue keys again which are not persisted for a while, their save failed
+func (pc *PollCapture) requeue(queue chan *SyncTask) {
+	idle := time.Duration(pc.config.Requeue) * time.Millisecond
+	keys := make([]string, 0)
+	pc.mu.Lock()
+	for key, d := range pc.queued {
+		if time.Since(d.at) >= idle {
+			keys = append(keys, key)
+		}
+	}
+	pc.mu.Unlock()
+	if len(keys) > 0 {
+		Info("requeue %d keys from %s", len(keys), pc.config.Processing)
+		pc.dispatch(queue, keys)
+	}
+}
+
+// return the number of popped keys
+func (pc *PollCapture) poll(queue chan *SyncTask) (int, error) {
+	resp, err := pc.cli.Exec("eval", POLL_SCRIPT, 2, pc.config.Name, pc.config.Processing,
+		pc.config.Type, pc.config.Batch)
+	if err != nil {
+		return 0, err
+	}
+	keys, _ := resp.([]string)
+	if len(keys) > 0 {
+		Info("pop %d keys from %s", len(keys), pc.config.Name)
+	}
+	pc.dispatch(queue, keys)
+	return len(keys), nil
+}
+
+func (pc *PollCapture) reconnect() bool {
+	times := 0
+	for {
+		wait := times
+		times = times + 1
+		if wait > 30 {
+			wait = 30
+		}
+		Info("try to reconnect poll capture, times:%d, wait:%d", times, wait)
+		select {
+		case <-pc.quit:
+			return false
+		case <-time.After(time.Duration(wait) * time.Second):
+		}
+
+		if err := pc.cli.ReConnect(); err != nil {
+			Error("reconnect poll capture failed:%v", err)
+			continue
+		}
+		return true
+	}
+}
+
+func (pc *PollCapture) Start(queue chan *SyncTask) {
+	defer close(pc.done)
+	defer close(queue)
+
+	if err := pc.cli.Connect(); err != nil {
+		Panic("start poll capture failed:%v", err)
+	}
+	if err := pc.recover(queue); err != nil {
+		Panic("start poll capture failed:%v", err)
+	}
+	Info("start poll capture succeed, %s:%s", pc.config.Type, pc.config.Name)
+
+	interval := time.Duration(pc.config.Interval) * time.Millisecond
+	requeue_interval := time.Duration(pc.config.Requeue) * time.Millisecond
+	last_requeue := time.Now()
+	for {
+		if time.Since(last_requeue) >= requeue_interval {
+			pc.requeue(queue)
+			last_requeue = time.Now()
+		}
+		err := pc.flushAcks()
+		n := 0
+		if err == nil {
+			n, err = pc.poll(queue)
+		}
+		if err != nil {
+			Error("poll dirty keys failed, try to reconnect to redis:%v", err)
+			if !pc.reconnect() {
+				return
+			}
+			continue
+		}
+
+		// keep popping while there is a backlog
+		wait := interval
+		if n >= pc.config.Batch {
+			wait = 0
+		}
+		select {
+		case <-pc.quit:
+			if err := pc.flushAcks(); err != nil {
+				Error("remove persisted keys from %s failed:%v", pc.config.Processing, err)
+			}
+			pc.cli.Close()
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (pc *PollCapture) Stop() {
+	close(pc.quit)
+	<-pc.done
+}
+
+func NewPollCapture(source *Redis) *PollCapture {
+	cli := redis.NewRedis(source.Host, source.Password, source.Db)
+	return &PollCapture{
+		cli:    cli,
+		config: &source.Poll,
+		queued: make(map[string]pollDispatch),
+		quit:   make(chan bool),
+		done:   make(chan bool),
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPollAcks(t *testing.T) {
+	pc := NewPollCapture(&Redis{Poll: PollConfig{Name: "dirty"}})
+	queue := make(chan *SyncTask, 10)
+
+	pc.dispatch(queue, []string{"a", "b"})
+	first_a, first_b := <-queue, <-queue
+	first_a.Done()
+	first_b.Done()
+
+	// a is popped again before the acks are flushed, its second save is running
+	pc.dispatch(queue, []string{"a"})
+	second_a := <-queue
+	if keys := pc.takeAcks(); !reflect.DeepEqual(keys, []interface{}{"b"}) {
+		t.Errorf("expect only b acked, got %v", keys)
+	}
+
+	second_a.Done()
+	if keys := pc.takeAcks(); !reflect.DeepEqual(keys, []interface{}{"a"}) {
+		t.Errorf("expect a acked after its second save, got %v", keys)
+	}
+
+	// a late save of an earlier pop doesn't ack a key popped again
+	pc.dispatch(queue, []string{"c"})
+	first_c := <-queue
+	pc.dispatch(queue, []string{"c"})
+	second_c := <-queue
+	first_c.Done()
+	if keys := pc.takeAcks(); len(keys) != 0 {
+		t.Errorf("expect nothing acked, got %v", keys)
+	}
+	second_c.Done()
+	if keys := pc.takeAcks(); !reflect.DeepEqual(keys, []interface{}{"c"}) {
+		t.Errorf("expect c acked, got %v", keys)
+	}
+}
+
+// keys whose save failed are queued again once they are idle for requeue ms
+func TestPollRequeue(t *testing.T) {
+	pc := NewPollCapture(&Redis{Poll: PollConfig{Name: "dirty", Requeue: 10}})
+	queue := make(chan *SyncTask, 10)
+
+	pc.dispatch(queue, []string{"a", "b"})
+	failed, saved := <-queue, <-queue
+	saved.Done()
+	pc.requeue(queue)
+	if len(queue) != 0 {
+		t.Fatalf("requeued before idle")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	pc.requeue(queue)
+	if len(queue) != 1 {
+		t.Fatalf("%d keys requeued, expect 1", len(queue))
+	}
+	retry := <-queue
+	if retry.Key != "a" {
+		t.Fatalf("requeued %s, expect a", retry.Key)
+	}
+	// only the save of the last dispatch acks the key
+	failed.Done()
+	if keys := pc.takeAcks(); !reflect.DeepEqual(keys, []interface{}{"b"}) {
+		t.Errorf("expect b acked, got %v", keys)
+	}
+	retry.Done()
+	if keys := pc.takeAcks(); !reflect.DeepEqual(keys, []interface{}{"a"}) {
+		t.Errorf("expect a acked after its retry, got %v", keys)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// binary record layout:
+//
+//	format(1) type(1) timestamp(varint) expire_at(varint) version(len+bytes)
+//	count(uvarint) followed by count pairs of length-prefixed field and value.
+//
+// v1 records have no expire_at, old records are plain json objects and always
+// start with '{'.
+const (
+	RECORD_FORMAT_V1   byte = 1
+	RECORD_FORMAT_V2   byte = 2
+	RECORD_FORMAT_JSON byte = '{'
+)
+
+const (
+	RECORD_TYPE_HASH byte = 1
+)
+
+var MalformedRecord = errors.New("malformed record")
+var RecordExpired = errors.New("record expired")
+
+type Record struct {
+	Key       string            `json:"key"`
+	Type      string            `json:"type"`
+	Version   string            `json:"version"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	ExpireAt  int64             `json:"expire_at,omitempty"` // unix ms, 0 if the key has no ttl
+	Fields    map[string]string `json:"fields"`
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// remaining ttl in ms, -1 if the record never expires, 0 if it has expired
+func (rec *Record) Ttl() int64 {
+	if rec.ExpireAt <= 0 {
+		return -1
+	}
+	if ttl := rec.ExpireAt - nowMs(); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+func putBytes(buf *bytes.Buffer, b []byte) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(b)))
+	buf.Write(tmp[:n])
+	buf.Write(b)
+}
+
+func encodeRecord(rec *Record) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(RECORD_FORMAT_V2)
+	buf.WriteByte(RECORD_TYPE_HASH)
+	n := binary.PutVarint(tmp[:], rec.Timestamp)
+	buf.Write(tmp[:n])
+	n = binary.PutVarint(tmp[:], rec.ExpireAt)
+	buf.Write(tmp[:n])
+	putBytes(buf, []byte(rec.Version))
+	n = binary.PutUvarint(tmp[:], uint64(len(rec.Fields)))
+	buf.Write(tmp[:n])
+
+	// keep output stable
+	fields := make([]string, 0, len(rec.Fields))
+	for field := range rec.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		putBytes(buf, []byte(field))
+		putBytes(buf, []byte(rec.Fields[field]))
+	}
+	return buf.Bytes()
+}
+
+func readBytes(reader *bytes.Reader) ([]byte, error) {
+	sz, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if sz > uint64(reader.Len()) {
+		return nil, MalformedRecord
+	}
+	b := make([]byte, sz)
+	reader.Read(b)
+	return b, nil
+}
+
+func decodeBinaryRecord(rec *Record, chunk []byte) (err error) {
+	reader := bytes.NewReader(chunk[1:])
+	var typ byte
+	if typ, err = reader.ReadByte(); err != nil {
+		return
+	}
+	if typ != RECORD_TYPE_HASH {
+		return MalformedRecord
+	}
+	if rec.Timestamp, err = binary.ReadVarint(reader); err != nil {
+		return
+	}
+	if chunk[0] == RECORD_FORMAT_V2 {
+		if rec.ExpireAt, err = binary.ReadVarint(reader); err != nil {
+			return
+		}
+	}
+	var b []byte
+	if b, err = readBytes(reader); err != nil {
+		return
+	}
+	rec.Version = string(b)
+	var count uint64
+	if count, err = binary.ReadUvarint(reader); err != nil {
+		return
+	}
+	// every pair takes at least two bytes
+	if count > uint64(reader.Len())/2 {
+		return MalformedRecord
+	}
+	rec.Fields = make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+		var field, value []byte
+		if field, err = readBytes(reader); err != nil {
+			return
+		}
+		if value, err = readBytes(reader); err != nil {
+			return
+		}
+		rec.Fields[string(field)] = string(value)
+	}
+	if reader.Len() > 0 {
+		return MalformedRecord
+	}
+	return
+}
+
+func decodeRecord(key string, chunk []byte) (rec *Record, err error) {
+	if len(chunk) == 0 {
+		err = MalformedRecord
+		return
+	}
+
+	rec = &Record{Key: key, Type: "hash"}
+	switch chunk[0] {
+	case RECORD_FORMAT_JSON:
+		if err = json.Unmarshal(chunk, &rec.Fields); err != nil {
+			return
+		}
+		rec.Version = versionOf(rec.Fields)
+	case RECORD_FORMAT_V1, RECORD_FORMAT_V2:
+		// truncated varints and lengths all mean the same to callers
+		if decodeBinaryRecord(rec, chunk) != nil {
+			err = MalformedRecord
+			return
+		}
+	default:
+		err = MalformedRecord
+		return
+	}
+
+	if rec.Fields == nil {
+		rec.Fields = make(map[string]string)
+	}
+	return
+}
+
+// describe a ttl in ms as returned by PTTL or Record.Ttl
+func formatTtl(ttl int64) string {
+	switch {
+	case ttl == -2:
+		return "missing"
+	case ttl < 0:
+		return "none"
+	case ttl == 0:
+		return "expired"
+	}
+	expire_at := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	return fmt.Sprintf("%dms, expire at %s", ttl, expire_at.Format(time.RFC3339))
+}
+
+func isLegacyRecord(chunk []byte) bool {
+	return len(chunk) > 0 && chunk[0] == RECORD_FORMAT_JSON
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	records := []*Record{
+		{Key: "uid:1", Type: "hash", Version: "12", Timestamp: 1500000000000, Fields: map[string]string{"version": "12", "name": "foo"}},
+		{Key: "uid:2", Type: "hash", Version: "", Timestamp: -1, ExpireAt: 1800000000000, Fields: map[string]string{}},
+		{Key: "uid:3", Type: "hash", Version: "3", Fields: map[string]string{"": "", "bin": "\x00\xff\r\n", "long": string(make([]byte, 1000))}},
+	}
+	for _, rec := range records {
+		chunk := encodeRecord(rec)
+		if chunk[0] != RECORD_FORMAT_V2 {
+			t.Errorf("key:%s encoded with format %d", rec.Key, chunk[0])
+		}
+		got, err := decodeRecord(rec.Key, chunk)
+		if err != nil {
+			t.Errorf("decode key:%s failed:%v", rec.Key, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, rec) {
+			t.Errorf("round trip of key:%s, expect %#v, got %#v", rec.Key, rec, got)
+		}
+		if !bytes.Equal(encodeRecord(got), chunk) {
+			t.Errorf("encoding of key:%s isn't stable", rec.Key)
+		}
+	}
+}
+
+func TestDecodeLegacyRecords(t *testing.T) {
+	old := setting.Version.Field
+	setting.Version.Field = "version"
+	defer func() { setting.Version.Field = old }()
+
+	rec, err := decodeRecord("k", []byte(`{"version":"7","a":"b"}`))
+	if err != nil {
+		t.Fatalf("decode json record failed:%v", err)
+	}
+	if rec.Version != "7" || rec.Fields["a"] != "b" || rec.ExpireAt != 0 {
+		t.Errorf("unexpected json record:%#v", rec)
+	}
+
+	// v1 is v2 without expire_at
+	v2 := encodeRecord(&Record{Key: "k", Version: "1", Timestamp: 5, Fields: map[string]string{"a": "b"}})
+	v1 := append([]byte{RECORD_FORMAT_V1, RECORD_TYPE_HASH, v2[2]}, v2[4:]...)
+	if rec, err = decodeRecord("k", v1); err != nil {
+		t.Fatalf("decode v1 record failed:%v", err)
+	}
+	if rec.Version != "1" || rec.Timestamp != 5 || rec.Fields["a"] != "b" {
+		t.Errorf("unexpected v1 record:%#v", rec)
+	}
+}
+
+func TestDecodeCorruptRecords(t *testing.T) {
+	chunk := encodeRecord(&Record{Key: "k", Version: "1", Timestamp: 1, Fields: map[string]string{"a": "bc", "d": "e"}})
+
+	// every truncation must fail instead of returning a partial record
+	for i := 0; i < len(chunk); i++ {
+		if _, err := decodeRecord("k", chunk[:i]); err != MalformedRecord {
+			t.Errorf("truncated at %d/%d, err:%v", i, len(chunk), err)
+		}
+	}
+
+	var tmp [binary.MaxVarintLen64]byte
+	huge := tmp[:binary.PutUvarint(tmp[:], 1<<62)]
+	header := []byte{RECORD_FORMAT_V2, RECORD_TYPE_HASH, 2, 0}
+	cases := map[string][]byte{
+		"empty":             {},
+		"unknown format":    {9, RECORD_TYPE_HASH, 0, 0, 0, 0},
+		"unknown type":      {RECORD_FORMAT_V2, 9, 0, 0, 0, 0},
+		"oversized version": append(append([]byte{}, header...), huge...),
+		"oversized count":   append(append(append([]byte{}, header...), 0), huge...),
+		"oversized field":   append(append(append([]byte{}, header...), 0, 1), huge...),
+		"overlong varint":   {RECORD_FORMAT_V2, RECORD_TYPE_HASH, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"trailing bytes":    append(append([]byte{}, chunk...), 0),
+		"broken json":       []byte(`{"a":`),
+	}
+	for name, chunk := range cases {
+		if _, err := decodeRecord("k", chunk); err == nil {
+			t.Errorf("%s: decoded without error", name)
+		}
+	}
+}
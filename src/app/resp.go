@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// serve read-only redis commands from leveldb
+type RespHandler func(ud interface{}, w *RespWriter, args []string) error
+
+type RespSvr struct {
+	ln       net.Listener
+	addr     string
+	db       *Leveldb
+	handlers map[string][]interface{}
+	cursors  *scanCursors
+	wg       sync.WaitGroup
+}
+
+const MAX_SCAN_CURSORS int = 4096
+
+// redis clients expect numeric cursors, so each one stands for the key the
+// next page starts at. The oldest cursors are forgotten first
+type scanCursors struct {
+	mu    sync.Mutex
+	next  uint64
+	keys  map[uint64]string
+	order []uint64
+}
+
+func newScanCursors() *scanCursors {
+	return &scanCursors{keys: make(map[uint64]string)}
+}
+
+func (c *scanCursors) Save(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.next++
+	c.keys[c.next] = key
+	c.order = append(c.order, c.next)
+	if len(c.order) > MAX_SCAN_CURSORS {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	return c.next
+}
+
+func (c *scanCursors) Lookup(cursor uint64) (key string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok = c.keys[cursor]
+	return
+}
+
+type RespWriter struct {
+	w *bufio.Writer
+}
+
+func (w *RespWriter) Status(s string) {
+	fmt.Fprintf(w.w, "+%s\r\n", s)
+}
+
+func (w *RespWriter) Error(s string) {
+	fmt.Fprintf(w.w, "-%s\r\n", s)
+}
+
+func (w *RespWriter) Int(n int) {
+	fmt.Fprintf(w.w, ":%d\r\n", n)
+}
+
+func (w *RespWriter) Nil() {
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *RespWriter) Bulk(s string) {
+	fmt.Fprintf(w.w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w *RespWriter) ArrayHeader(n int) {
+	fmt.Fprintf(w.w, "*%d\r\n", n)
+}
+
+func (w *RespWriter) Array(items []string) {
+	w.ArrayHeader(len(items))
+	for _, item := range items {
+		w.Bulk(item)
+	}
+}
+
+// accept both multibulk and inline commands, small ones until auth succeeds
+func readRespRequest(reader *bufio.Reader, role int) (args []string, err error) {
+	b, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if b[0] == '*' {
+		if role == ROLE_NONE {
+			return readRespCommand(reader, RESP_NOAUTH_MAX_ARGS, RESP_NOAUTH_MAX_BULK)
+		}
+		return readRespCommand(reader, RESP_MAX_ARGS, RESP_MAX_BULK)
+	}
+
+	line, err := readRespLine(reader)
+	if err != nil {
+		return
+	}
+	args = strings.Fields(line)
+	return
+}
+
+func (self *RespSvr) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	defer self.wg.Done()
+	defer func() {
+		if err := recover(); err != nil {
+			Error("handle resp connection:%v failed:%v", conn.RemoteAddr(), err)
+		}
+	}()
+
+	Info("new resp connection:%v", conn.RemoteAddr())
+	reader := bufio.NewReader(conn)
+	w := &RespWriter{bufio.NewWriter(conn)}
+	role := defaultRole()
+	for {
+		args, err := readRespRequest(reader, role)
+		if err != nil {
+			if err != io.EOF {
+				Error("read resp conn:%v failed:%v", conn.RemoteAddr(), err)
+			}
+			break
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		cmd := strings.ToLower(args[0])
+		if cmd == "quit" {
+			w.Status("OK")
+			w.w.Flush()
+			break
+		}
+		cb, ok := self.handlers[cmd]
+		if cmd == "auth" {
+			role = respAuth(w, args[1:], role)
+		} else if !ok {
+			w.Error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		} else if role == ROLE_NONE {
+			w.Error("NOAUTH Authentication required.")
+		} else if role < requiredRole(respRoles, cmd) {
+			w.Error("NOPERM " + PermissionDenied.Error())
+		} else {
+			handler := cb[1].(RespHandler)
+			if err = handler(cb[0], w, args[1:]); err != nil {
+				w.Error("ERR " + err.Error())
+			}
+		}
+
+		// flush once the pipeline is drained
+		if reader.Buffered() == 0 {
+			if err = w.w.Flush(); err != nil {
+				Error("write resp conn:%v failed:%v", conn.RemoteAddr(), err)
+				break
+			}
+		}
+	}
+	Info("end resp connection:%v", conn.RemoteAddr())
+}
+
+func (self *RespSvr) Register(cmd string, ud interface{}, handler RespHandler) {
+	self.handlers[cmd] = []interface{}{ud, handler}
+}
+
+func (self *RespSvr) Start() {
+	self.wg.Add(1)
+	defer self.wg.Done()
+
+	ln, err := listen(self.addr, &setting.Resp.Tls)
+	if err != nil {
+		Panic("start resp server failed:%v", err)
+	}
+	Info("start resp server succeed:%s", self.addr)
+
+	self.ln = ln
+	for {
+		conn, err := self.ln.Accept()
+		if err != nil {
+			Error("accept failed:%v", err)
+			if opErr, ok := err.(*net.OpError); ok {
+				if !opErr.Temporary() {
+					break
+				}
+			}
+			continue
+		}
+		self.wg.Add(1)
+		go self.handleConnection(conn)
+	}
+}
+
+func (self *RespSvr) Stop() {
+	if self.ln != nil {
+		self.ln.Close()
+	}
+	self.wg.Wait()
+}
+
+type WrongArgs string
+
+func (e WrongArgs) Error() string {
+	return fmt.Sprintf("wrong number of arguments for '%s' command", string(e))
+}
+
+var respRoles = map[string]int{
+	"ping":    ROLE_READ,
+	"select":  ROLE_READ,
+	"hgetall": ROLE_READ,
+	"hget":    ROLE_READ,
+	"hmget":   ROLE_READ,
+	"hexists": ROLE_READ,
+	"hlen":    ROLE_READ,
+	"exists":  ROLE_READ,
+	"type":    ROLE_READ,
+	"scan":    ROLE_READ,
+	"load":    ROLE_OPERATOR,
+}
+
+// auth [username] token, the username is ignored
+func respAuth(w *RespWriter, args []string, role int) int {
+	if len(args) != 1 && len(args) != 2 {
+		w.Error("ERR " + WrongArgs("auth").Error())
+		return role
+	}
+	if !authEnabled() {
+		w.Error("ERR AUTH called without any credential configured")
+		return role
+	}
+	_, r, err := authenticate(args[len(args)-1])
+	if err != nil {
+		w.Error("WRONGPASS " + err.Error())
+		return ROLE_NONE
+	}
+	w.Status("OK")
+	return r
+}
+
+func respPing(ud interface{}, w *RespWriter, args []string) error {
+	if len(args) > 0 {
+		w.Bulk(args[0])
+	} else {
+		w.Status("PONG")
+	}
+	return nil
+}
+
+// data is read only, accept select to keep clients happy
+func respSelect(ud interface{}, w *RespWriter, args []string) error {
+	w.Status("OK")
+	return nil
+}
+
+func respHgetall(ud interface{}, w *RespWriter, args []string) error {
+	if len(args) != 1 {
+		return WrongArgs("hgetall")
+	}
+	db := ud.(*Leveldb)
+	rec, err := db.GetRecord(args[0])
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		w.ArrayHeader(0)
+		return nil
+	}
+	w.ArrayHeader(len(rec.Fields) * 2)
+	for k, v := range rec.Fields {
+		w.Bulk(k)
+		w.Bulk(v)
+	}
+	return nil
+}
+
+func respHget(ud interface{}, w *RespWriter, args []string) error {
+	if len(args) != 2 {
+		return WrongArgs("hget")
+	}
+	db := ud.(*Leveldb)
+	rec, err := db.GetRecord(args[0])
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		w.Nil()
+		return nil
+	}
+	if v, ok := rec.Fields[args[1]]; ok {
+		w.Bulk(v)
+	} else {
+		w.Nil()
+	}
+	return nil
+}
+
+func respHmget(ud interface{}, w *RespWriter, args []string) error {
+	if len(args) < 2 {
+		return WrongArgs("hmget")
+	}
+	db := ud.(*Leveldb)
+	rec, err := db.GetRecord(args[0])
+	if err != nil {
+		return err
+	}
+	w.ArrayHeader(len(args) - 1)
+	for _, field := range args[1:] {
+		if rec == nil {
+			w.Nil()
+		} else if v, ok := rec.Fields[field]; ok {
+			w.Bulk(v)
+		} else {
+			w.Nil()
+		}
+	}
+	return nil
+}
+
+func respHexists(ud interface{}, w *RespWriter, args []string) error {
+	if len(args) != 2 {
+		return WrongArgs("hexists")
+	}
+	db := ud.(*Leveldb)
+	rec, err := db.GetRecord(args[0])
+	if err != nil {
+		return err
+	}
+	n := 0
+	if rec != nil {
+		if _, ok := rec.Fields[args[1]]; ok {
+			n = 1
+		}
+	}
+	w.Int(n)
+	return nil
+}
+
+func respHlen(ud interface{}, w *RespWriter, args []string) error {
+	if len(args) != 1 {
+		return WrongArgs("hlen")
+	}
+	db := ud.(*Leveldb)
+	rec, err := db.GetRecord(args[0])
+	if err != nil {
+		return err
+	}
+	n := 0
+	if rec != nil {
+		n = len(rec.Fields)
+	}
+	w.Int(n)
+	return nil
+}
+
+func respExists(ud interface{}, w *RespWriter, args []string) error {
+	if len(args) < 1 {
+		return WrongArgs("exists")
+	}
+	db := ud.(*Leveldb)
+	n := 0
+	for _, key := range args {
+		version, err := db.Get([]byte(indexKey(key)))
+		if err != nil {
+			return err
+		}
+		if version != nil {
+			n++
+		}
+	}
+	w.Int(n)
+	return nil
+}
+
+func respType(ud interface{}, w *RespWriter, args []string) error {
+	if len(args) != 1 {
+		return WrongArgs("type")
+	}
+	db := ud.(*Leveldb)
+	version, err := db.Get([]byte(indexKey(args[0])))
+	if err != nil {
+		return err
+	}
+	if version != nil {
+		w.Status("hash")
+	} else {
+		w.Status("none")
+	}
+	return nil
+}
+
+// scan cursor [match pattern] [count n], count keys are visited per call
+func respScan(ud interface{}, w *RespWriter, args []string) error {
+	if len(args) < 1 || len(args)%2 != 1 {
+		return WrongArgs("scan")
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	pattern := ""
+	count := 10
+	for i := 1; i < len(args); i = i + 2 {
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return fmt.Errorf("value is not an integer or out of range")
+			}
+			if count > MAX_SCAN_COUNT {
+				count = MAX_SCAN_COUNT
+			}
+		default:
+			return fmt.Errorf("syntax error")
+		}
+	}
+
+	svr := ud.(*RespSvr)
+	from := INDEX_KEY_START
+	if cursor != 0 {
+		key, ok := svr.cursors.Lookup(cursor)
+		if !ok {
+			return fmt.Errorf("invalid cursor")
+		}
+		from = []byte(indexKey(key))
+	}
+
+	it := svr.db.NewIterator()
+	defer it.Close()
+
+	keys := make([]string, 0)
+	visited := 0
+	next := uint64(0)
+	for it.Seek(from); it.Valid() && bytes.Compare(it.Key(), INDEX_KEY_END) <= 0; it.Next() {
+		key := string(it.Key()[INDEX_KEY_LEN:])
+		if visited >= count {
+			next = svr.cursors.Save(key)
+			break
+		}
+		visited++
+		if pattern == "" || matchPattern(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	if err = it.GetError(); err != nil {
+		return err
+	}
+
+	w.ArrayHeader(2)
+	w.Bulk(strconv.FormatUint(next, 10))
+	w.Array(keys)
+	return nil
+}
+
+func NewRespSvr(db *Leveldb, loader *Loader) *RespSvr {
+	svr := new(RespSvr)
+	svr.addr = setting.Resp.Addr
+	svr.db = db
+	svr.handlers = make(map[string][]interface{})
+	svr.cursors = newScanCursors()
+
+	svr.Register("ping", db, respPing)
+	svr.Register("select", db, respSelect)
+	svr.Register("hgetall", db, respHgetall)
+	svr.Register("hget", db, respHget)
+	svr.Register("hmget", db, respHmget)
+	svr.Register("hexists", db, respHexists)
+	svr.Register("hlen", db, respHlen)
+	svr.Register("exists", db, respExists)
+	svr.Register("type", db, respType)
+	svr.Register("scan", svr, respScan)
+	svr.Register("load", loader, respLoad)
+	return svr
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// run scan and parse its reply
+func scan(t *testing.T, svr *RespSvr, args ...string) (string, []string) {
+	var buf bytes.Buffer
+	w := &RespWriter{bufio.NewWriter(&buf)}
+	if err := respScan(svr, w, args); err != nil {
+		t.Fatalf("scan %v failed:%v", args, err)
+	}
+	w.w.Flush()
+
+	reader := bufio.NewReader(&buf)
+	if line, _ := readRespLine(reader); line != "*2" {
+		t.Fatalf("unexpected reply:%q", line)
+	}
+	readRespLine(reader)
+	cursor, _ := readRespLine(reader)
+	keys, err := readRespCommand(reader, RESP_MAX_ARGS, RESP_MAX_BULK)
+	if err != nil {
+		t.Fatalf("read keys failed:%v", err)
+	}
+	return cursor, keys
+}
+
+func TestRespScan(t *testing.T) {
+	db := newTestLeveldb(t, nil)
+	for _, key := range []string{"a:1", "a:2", "b:1", "a:3", "b:2"} {
+		db.PutRecord(&Record{Key: key, Version: "1", Fields: map[string]string{}})
+	}
+	svr := &RespSvr{db: db, cursors: newScanCursors()}
+
+	all := make([]string, 0)
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("scan doesn't end")
+		}
+		var keys []string
+		cursor, keys = scan(t, svr, cursor, "count", "2")
+		all = append(all, keys...)
+		if cursor == "0" {
+			break
+		}
+		// a key inserted before the cursor doesn't shift the next page
+		db.PutRecord(&Record{Key: "0", Version: "1", Fields: map[string]string{}})
+	}
+	if expect := []string{"a:1", "a:2", "a:3", "b:1", "b:2"}; !reflect.DeepEqual(all, expect) {
+		t.Errorf("expect %v, got %v", expect, all)
+	}
+
+	// count keys are visited, matching or not
+	cursor, keys := scan(t, svr, "0", "match", "b:*", "count", "4")
+	if cursor == "0" || !reflect.DeepEqual(keys, []string{}) {
+		t.Errorf("first page of match, cursor:%s, keys:%v", cursor, keys)
+	}
+	if _, keys = scan(t, svr, cursor, "match", "b:*", "count", "4"); !reflect.DeepEqual(keys, []string{"b:1", "b:2"}) {
+		t.Errorf("second page of match, keys:%v", keys)
+	}
+
+	// redis globs, not file paths
+	if _, keys = scan(t, svr, "0", "match", "[ab]:[^2]"); !reflect.DeepEqual(keys, []string{"a:1", "a:3", "b:1"}) {
+		t.Errorf("match with classes, keys:%v", keys)
+	}
+
+	w := &RespWriter{bufio.NewWriter(&bytes.Buffer{})}
+	for _, cursor := range []string{"-1", "x", "12345"} {
+		if err := respScan(svr, w, []string{cursor}); err == nil {
+			t.Errorf("cursor %s accepted", cursor)
+		}
+	}
+}
+
+func TestScanCursorsLimit(t *testing.T) {
+	c := newScanCursors()
+	first := c.Save("a")
+	for i := 0; i < MAX_SCAN_CURSORS; i++ {
+		c.Save("b")
+	}
+	if _, ok := c.Lookup(first); ok {
+		t.Errorf("oldest cursor kept")
+	}
+	if key, ok := c.Lookup(first + 1); !ok || key != "b" {
+		t.Errorf("recent cursor lost")
+	}
+}
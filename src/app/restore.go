@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis"
+)
+
+// redis hosts restore may write to besides the one of the source, so a
+// manager or http token can't push data anywhere
+type RestoreConfig struct {
+	Hosts []string
+}
+
+func allowedRestoreHost(source *Redis, host string) bool {
+	if host == source.Host {
+		return true
+	}
+	for _, h := range setting.Restore.Hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// where and how restore writes, the configured redis by default
+type RestoreOptions struct {
+	Policy    string
+	Host      string
+	Password  string
+	Db        int
+	From      string // restore only keys with this prefix
+	To        string // and replace the prefix with this in the target
+	Rate      int    // keys per second, 0 means unlimited
+	Namespace string // restore only keys of this namespace
+}
+
+// [policy] [policy=] [host=] [password=] [db=] [from=] [to=] [rate=] [ns=]
+func parseRestoreOptions(source *Redis, args []string) (opts *RestoreOptions, err error) {
+	opts = &RestoreOptions{Host: source.Host, Password: source.Password, Db: source.Db}
+	password_set := false
+	host_set := false
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i < 0 {
+			opts.Policy = arg
+			continue
+		}
+		name, value := arg[:i], arg[i+1:]
+		switch name {
+		case "policy":
+			opts.Policy = value
+		case "host":
+			opts.Host = value
+			host_set = true
+		case "password":
+			opts.Password = value
+			password_set = true
+		case "db":
+			opts.Db, err = strconv.Atoi(value)
+		case "from":
+			opts.From = value
+		case "to":
+			opts.To = value
+		case "rate":
+			opts.Rate, err = strconv.Atoi(value)
+		case "ns":
+			if lookupNamespace(value) == nil {
+				err = fmt.Errorf("unknown namespace: %s", value)
+			}
+			opts.Namespace = value
+		default:
+			err = fmt.Errorf("unknown restore option: %s", name)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if !allowedRestoreHost(source, opts.Host) {
+		err = fmt.Errorf("host %s isn't in restore.hosts", opts.Host)
+		return
+	}
+	// never send the production password to another host
+	if host_set && !password_set {
+		opts.Password = ""
+	}
+	if opts.To != "" && opts.From == "" {
+		err = fmt.Errorf("to needs from")
+		return
+	}
+	opts.Policy, err = restorePolicy(opts.Policy)
+	return
+}
+
+func (o *RestoreOptions) Connect() (cli *redis.Redis, err error) {
+	cli = redis.NewRedis(o.Host, o.Password, o.Db)
+	err = cli.Connect()
+	return
+}
+
+func (o *RestoreOptions) Match(key string) bool {
+	if !strings.HasPrefix(key, o.From) {
+		return false
+	}
+	if o.Namespace == "" {
+		return true
+	}
+	ns := namespaceOf(key)
+	return ns != nil && ns.Name == o.Namespace
+}
+
+func (o *RestoreOptions) TargetKey(key string) string {
+	if o.To == "" {
+		return key
+	}
+	return o.To + strings.TrimPrefix(key, o.From)
+}
+
+func (o *RestoreOptions) String() string {
+	s := fmt.Sprintf("%s/%d, policy:%s", o.Host, o.Db, o.Policy)
+	if o.From != "" {
+		s += fmt.Sprintf(", from:%s, to:%s", o.From, o.To)
+	}
+	if o.Rate > 0 {
+		s += fmt.Sprintf(", rate:%d/s", o.Rate)
+	}
+	if o.Namespace != "" {
+		s += fmt.Sprintf(", namespace:%s", o.Namespace)
+	}
+	return s
+}
+
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// rate per second, never blocks if it's not positive
+func newRateLimiter(rate int) *rateLimiter {
+	l := &rateLimiter{}
+	if rate > 0 {
+		l.interval = time.Second / time.Duration(rate)
+	}
+	return l
+}
+
+func (l *rateLimiter) Wait() {
+	if l.interval <= 0 {
+		return
+	}
+	now := time.Now()
+	if l.next.After(now) {
+		time.Sleep(l.next.Sub(now))
+	} else {
+		l.next = now
+	}
+	l.next = l.next.Add(l.interval)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseRestoreOptions(t *testing.T) {
+	setVersion(t, VersionConfig{})
+	setNamespaces(t, []NamespaceConfig{{Name: "user", Pattern: "uid:*"}})
+	old := setting.Restore
+	setting.Restore.Hosts = []string{"10.0.0.2:6379"}
+	defer func() { setting.Restore = old }()
+	source := &Redis{Host: "127.0.0.1:6379", Password: "secret", Db: 2}
+
+	opts, err := parseRestoreOptions(source, nil)
+	if err != nil {
+		t.Fatalf("parse no options failed:%v", err)
+	}
+	if opts.Host != source.Host || opts.Password != "secret" || opts.Db != 2 || opts.Policy != CONFLICT_NEWER_WINS {
+		t.Errorf("unexpected defaults:%#v", opts)
+	}
+
+	opts, err = parseRestoreOptions(source, []string{"leveldb-wins", "host=10.0.0.2:6379", "db=1",
+		"from=uid:", "to=staging:uid:", "rate=5000", "ns=user"})
+	if err != nil {
+		t.Fatalf("parse options failed:%v", err)
+	}
+	expect := RestoreOptions{Policy: CONFLICT_LEVELDB_WINS, Host: "10.0.0.2:6379", Db: 1,
+		From: "uid:", To: "staging:uid:", Rate: 5000, Namespace: "user"}
+	if *opts != expect {
+		t.Errorf("expect %#v, got %#v", expect, *opts)
+	}
+
+	// the password is only kept for the source host
+	if opts, _ = parseRestoreOptions(source, []string{"host=10.0.0.2:6379", "password=other"}); opts.Password != "other" {
+		t.Errorf("given password dropped")
+	}
+	if opts, _ = parseRestoreOptions(source, []string{"host=127.0.0.1:6379"}); opts.Password != "" {
+		t.Errorf("password kept after host is given")
+	}
+	if opts, _ = parseRestoreOptions(source, []string{"policy=redis-wins", "db=3"}); opts.Password != "secret" || opts.Policy != CONFLICT_REDIS_WINS {
+		t.Errorf("unexpected options:%#v", opts)
+	}
+
+	invalid := [][]string{
+		{"host=10.0.0.3:6379"},
+		{"unknown-wins"},
+		{"db=x"},
+		{"rate=x"},
+		{"to=staging:"},
+		{"ns=missing"},
+		{"color=red"},
+	}
+	for _, args := range invalid {
+		if _, err := parseRestoreOptions(source, args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
+
+func TestRestoreTargetKey(t *testing.T) {
+	setNamespaces(t, []NamespaceConfig{{Name: "user", Pattern: "uid:*"}, {Name: "default", Pattern: "*"}})
+	cases := []struct {
+		opts   RestoreOptions
+		key    string
+		match  bool
+		target string
+	}{
+		{RestoreOptions{}, "uid:1", true, "uid:1"},
+		{RestoreOptions{From: "uid:"}, "uid:1", true, "uid:1"},
+		{RestoreOptions{From: "uid:", To: "staging:uid:"}, "uid:1", true, "staging:uid:1"},
+		{RestoreOptions{From: "uid:", To: "x"}, "uid:", true, "x"},
+		{RestoreOptions{From: "uid:", To: "x"}, "gid:1", false, ""},
+		{RestoreOptions{Namespace: "user"}, "uid:1", true, "uid:1"},
+		{RestoreOptions{Namespace: "user"}, "gid:1", false, ""},
+	}
+	for _, c := range cases {
+		if match := c.opts.Match(c.key); match != c.match {
+			t.Errorf("%s: key %s expect match:%v", c.opts.String(), c.key, c.match)
+		}
+		if c.match {
+			if target := c.opts.TargetKey(c.key); target != c.target {
+				t.Errorf("%s: key %s expect target %s, got %s", c.opts.String(), c.key, c.target, target)
+			}
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(0)
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		l.Wait()
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("unlimited rate waited %v", elapsed)
+	}
+
+	// the first key goes at once, the next 10 are spread over 100ms
+	l = newRateLimiter(100)
+	start = time.Now()
+	for i := 0; i < 11; i++ {
+		l.Wait()
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("11 keys at 100/s took %v", elapsed)
+	}
+
+	// an idle limiter doesn't build up a burst
+	time.Sleep(50 * time.Millisecond)
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		l.Wait()
+	}
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("burst after idle, 3 keys took %v", elapsed)
+	}
+}
+
+// hashes larger than a lua unpack are written in chunks
+func TestReplaceHashLarge(t *testing.T) {
+	r := startFakeRedis(t)
+	cli, err := (&Redis{Host: r.Addr()}).Connect()
+	if err != nil {
+		t.Fatalf("connect failed:%v", err)
+	}
+	defer cli.Close()
+
+	fields := make(map[string]string)
+	for i := 0; i < LUA_MAX_UNPACK; i++ {
+		fields[fmt.Sprintf("f%d", i)] = "v"
+	}
+	if err = replaceHash(cli, "big", fields, 0); err != nil {
+		t.Fatalf("replace hash failed:%v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := len(r.hash("big")); n != len(fields) {
+		t.Errorf("%d fields written, expect %d", n, len(fields))
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redis"
+)
+
+// sink queue entry: INTERNAL_PREFIX '%' name '\0' seq(8 bytes, big endian) => json of Record
+const SINK_KEY_PREFIX string = INTERNAL_PREFIX + "%"
+const MAX_SINK_BACKOFF int = 60
+
+// Sink receives persisted records, Send is retried until it succeeds
+type Sink interface {
+	Send(recs []*Record) error
+	Close()
+}
+
+type SinkConfig struct {
+	Name     string
+	Type     string // webhook, file or redis
+	Batch    int
+	Url      string // webhook
+	Secret   string // webhook, sign body with hmac-sha256
+	Timeout  int    // webhook, seconds
+	Path     string // file
+	Host     string // redis
+	Password string // redis
+	Db       int    // redis
+	Stream   string // redis
+	MaxLen   int    // redis, approximate max length of the stream
+}
+
+type WebhookSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func (s *WebhookSink) Send(recs []*Record) error {
+	body, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.secret) > 0 {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responds %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *WebhookSink) Close() {
+}
+
+// append records as json lines
+type FileSink struct {
+	fp *os.File
+}
+
+func (s *FileSink) Send(recs []*Record) error {
+	w := bufio.NewWriter(s.fp)
+	encoder := json.NewEncoder(w)
+	for _, rec := range recs {
+		if err := encoder.Encode(rec); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.fp.Sync()
+}
+
+func (s *FileSink) Close() {
+	s.fp.Close()
+}
+
+// xadd every record into a redis stream
+type RedisStreamSink struct {
+	cli    *redis.Redis
+	stream string
+	maxlen int
+}
+
+func (s *RedisStreamSink) Send(recs []*Record) error {
+	if err := s.cli.Connect(); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		fields, err := json.Marshal(rec.Fields)
+		if err != nil {
+			return err
+		}
+		args := []interface{}{s.stream}
+		if s.maxlen > 0 {
+			args = append(args, "maxlen", "~", s.maxlen)
+		}
+		args = append(args, "*", "key", rec.Key, "version", rec.Version,
+			"timestamp", strconv.FormatInt(rec.Timestamp, 10), "fields", string(fields))
+		if _, err = s.cli.Exec("xadd", args...); err != nil {
+			// reconnect on next send
+			s.cli.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisStreamSink) Close() {
+	s.cli.Close()
+}
+
+func NewSink(config *SinkConfig) (Sink, error) {
+	switch config.Type {
+	case "webhook":
+		timeout := config.Timeout
+		if timeout <= 0 {
+			timeout = 5
+		}
+		client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+		return &WebhookSink{config.Url, []byte(config.Secret), client}, nil
+	case "file":
+		fp, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		return &FileSink{fp}, nil
+	case "redis":
+		cli := redis.NewRedis(config.Host, config.Password, config.Db)
+		return &RedisStreamSink{cli, config.Stream, config.MaxLen}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type: %s", config.Type)
+}
+
+// SinkQueue keeps records for one sink in leveldb until they are delivered
+type SinkQueue struct {
+	name      string
+	sink      Sink
+	db        *Leveldb
+	prefix    []byte
+	batch     int
+	next      uint64
+	delivered uint64
+	last_err  atomic.Value
+	notify    chan bool
+}
+
+func (q *SinkQueue) key(seq uint64) []byte {
+	key := make([]byte, len(q.prefix)+8)
+	copy(key, q.prefix)
+	binary.BigEndian.PutUint64(key[len(q.prefix):], seq)
+	return key
+}
+
+func (q *SinkQueue) Enqueue(batch *Batch, chunk []byte) {
+	seq := atomic.AddUint64(&q.next, 1)
+	batch.Put(q.key(seq), chunk)
+}
+
+func (q *SinkQueue) Notify() {
+	select {
+	case q.notify <- true:
+	default:
+	}
+}
+
+func (q *SinkQueue) Pending() uint64 {
+	return atomic.LoadUint64(&q.next) - atomic.LoadUint64(&q.delivered)
+}
+
+func (q *SinkQueue) read() (recs []*Record, keys [][]byte, err error) {
+	it := q.db.NewIterator()
+	defer it.Close()
+	for it.Seek(q.prefix); it.Valid() && bytes.HasPrefix(it.Key(), q.prefix) && len(recs) < q.batch; it.Next() {
+		var rec Record
+		if err = json.Unmarshal(it.Value(), &rec); err != nil {
+			Error("sink %s drop malformed entry:%v", q.name, err)
+		} else {
+			recs = append(recs, &rec)
+		}
+		keys = append(keys, it.Key())
+	}
+	err = it.GetError()
+	return
+}
+
+func (q *SinkQueue) run(quit chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer q.sink.Close()
+
+	backoff := 0
+	for {
+		recs, keys, err := q.read()
+		if err == nil && len(keys) == 0 {
+			select {
+			case <-q.notify:
+				continue
+			case <-quit:
+				return
+			}
+		}
+		if err == nil && len(recs) > 0 {
+			err = q.sink.Send(recs)
+		}
+		if err != nil {
+			q.last_err.Store(err.Error())
+			if backoff < MAX_SINK_BACKOFF {
+				backoff = backoff*2 + 1
+			}
+			Error("sink %s send %d records failed, retry in %ds:%v", q.name, len(recs), backoff, err)
+			select {
+			case <-time.After(time.Duration(backoff) * time.Second):
+				continue
+			case <-quit:
+				return
+			}
+		}
+		backoff = 0
+
+		batch := new(Batch)
+		for _, key := range keys {
+			batch.Delete(key)
+		}
+		if err = q.db.Write(batch); err != nil {
+			Error("sink %s ack failed:%v", q.name, err)
+			continue
+		}
+		atomic.AddUint64(&q.delivered, uint64(len(keys)))
+	}
+}
+
+type SinkMgr struct {
+	queues []*SinkQueue
+	quit   chan bool
+	wg     sync.WaitGroup
+}
+
+// add records into all sink queues in the same batch as the data
+func (m *SinkMgr) Enqueue(batch *Batch, rec *Record) {
+	chunk, err := json.Marshal(rec)
+	if err != nil {
+		Error("marshal record:%s for sinks failed:%v", rec.Key, err)
+		return
+	}
+	for _, q := range m.queues {
+		q.Enqueue(batch, chunk)
+	}
+}
+
+func (m *SinkMgr) Notify() {
+	for _, q := range m.queues {
+		q.Notify()
+	}
+}
+
+func (m *SinkMgr) Start() {
+	for _, q := range m.queues {
+		m.wg.Add(1)
+		go q.run(m.quit, &m.wg)
+	}
+}
+
+func (m *SinkMgr) Stop() {
+	close(m.quit)
+	m.wg.Wait()
+}
+
+// sinks of a source keep their queues under their names, which must be
+// distinct and can't contain the '\0' ending the queue prefix
+func checkSinks(configs []SinkConfig) error {
+	names := make(map[string]bool)
+	for _, c := range configs {
+		if c.Name == "" {
+			return errors.New("sink without name")
+		}
+		if strings.Contains(c.Name, "\x00") {
+			return fmt.Errorf("sink name %q contains '\\0'", c.Name)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate sink:%s", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return nil
+}
+
+func NewSinkMgr(db *Leveldb, configs []SinkConfig) *SinkMgr {
+	m := &SinkMgr{quit: make(chan bool)}
+	for i := range configs {
+		config := &configs[i]
+		sink, err := NewSink(config)
+		if err != nil {
+			Panic("create sink %s failed:%v", config.Name, err)
+		}
+		batch := config.Batch
+		if batch <= 0 {
+			batch = 100
+		}
+		q := &SinkQueue{
+			name:   config.Name,
+			sink:   sink,
+			db:     db,
+			prefix: []byte(SINK_KEY_PREFIX + config.Name + "\x00"),
+			batch:  batch,
+			notify: make(chan bool, 1),
+		}
+		q.next = db.lastSeq(q.prefix)
+		q.delivered = q.next
+		// count what is left from last run
+		it := db.NewIterator()
+		for it.Seek(q.prefix); it.Valid() && bytes.HasPrefix(it.Key(), q.prefix); it.Next() {
+			q.delivered--
+		}
+		it.Close()
+		m.queues = append(m.queues, q)
+		Info("sink %s(%s) pending:%d", q.name, config.Type, q.Pending())
+	}
+	return m
+}
+
+func sinks(ud interface{}, args []string) (result string, err error) {
+	context := ud.(*Context)
+	if context.db.sinks == nil {
+		result = "no sink"
+		return
+	}
+	buf := bytes.NewBufferString("sinks:\n")
+	for _, q := range context.db.sinks.queues {
+		last_err, _ := q.last_err.Load().(string)
+		fmt.Fprintf(buf, "%s: pending:%d, last error:%s\n", q.name, q.Pending(), last_err)
+	}
+	result = buf.String()
+	return
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckSinks(t *testing.T) {
+	cases := map[string]struct {
+		names []string
+		ok    bool
+	}{
+		"none":      {nil, true},
+		"distinct":  {[]string{"hook", "log"}, true},
+		"empty":     {[]string{""}, false},
+		"duplicate": {[]string{"hook", "log", "hook"}, false},
+		"nul":       {[]string{"a\x00b"}, false},
+	}
+	for name, c := range cases {
+		configs := make([]SinkConfig, len(c.names))
+		for i, n := range c.names {
+			configs[i] = SinkConfig{Name: n, Type: "file"}
+		}
+		if err := checkSinks(configs); (err == nil) != c.ok {
+			t.Errorf("%s: err:%v", name, err)
+		}
+	}
+}
+
+func putRecords(t *testing.T, db *Leveldb, from, to int) {
+	for i := from; i <= to; i++ {
+		rec := &Record{Key: fmt.Sprintf("uid:%d", i), Type: "hash", Version: "1", Fields: map[string]string{"version": "1"}}
+		if err := db.PutRecord(rec); err != nil {
+			t.Fatalf("put record failed:%v", err)
+		}
+	}
+}
+
+func waitDelivered(t *testing.T, q *SinkQueue) {
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("sink %s still has %d pending", q.name, q.Pending())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookSinkRetry(t *testing.T) {
+	var calls int32
+	bodies := make(chan []byte, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if r.Header.Get("X-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("bad signature:%s", r.Header.Get("X-Signature"))
+		}
+		// fail the first delivery
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies <- body
+	}))
+	defer hook.Close()
+
+	db := newTestLeveldb(t, nil)
+	db.sinks = NewSinkMgr(db, []SinkConfig{{Name: "hook", Type: "webhook", Url: hook.URL, Secret: "secret"}})
+	db.sinks.Start()
+	defer db.sinks.Stop()
+	putRecords(t, db, 1, 3)
+
+	q := db.sinks.queues[0]
+	waitDelivered(t, q)
+	if last_err, _ := q.last_err.Load().(string); last_err == "" {
+		t.Errorf("failed delivery isn't recorded")
+	}
+	var recs []*Record
+	for len(recs) < 3 {
+		var got []*Record
+		if err := json.Unmarshal(<-bodies, &got); err != nil {
+			t.Fatalf("unmarshal webhook body failed:%v", err)
+		}
+		recs = append(recs, got...)
+	}
+	for i, rec := range recs {
+		if rec.Key != fmt.Sprintf("uid:%d", i+1) {
+			t.Errorf("record %d is %s", i, rec.Key)
+		}
+	}
+	if n := countPrefix(db, q.prefix); n != 0 {
+		t.Errorf("%d delivered records left in the queue", n)
+	}
+}
+
+func TestSinkQueueRestart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sink.log")
+	configs := []SinkConfig{{Name: "log", Type: "file", Path: path}}
+	open := func() *Leveldb {
+		config := &LeveldbConfig{Dbname: filepath.Join(dir, "db")}
+		if err := config.setDefault(); err != nil {
+			t.Fatalf("invalid leveldb config:%v", err)
+		}
+		return NewLeveldb(config)
+	}
+
+	// nothing is delivered before the restart
+	db := open()
+	db.sinks = NewSinkMgr(db, configs)
+	putRecords(t, db, 1, 3)
+	if n := db.sinks.queues[0].Pending(); n != 3 {
+		t.Errorf("expect 3 pending, got %d", n)
+	}
+	db.sinks.Stop()
+	db.Close()
+
+	db = open()
+	defer db.Close()
+	db.sinks = NewSinkMgr(db, configs)
+	q := db.sinks.queues[0]
+	if n := q.Pending(); n != 3 {
+		t.Errorf("expect 3 pending after restart, got %d", n)
+	}
+	putRecords(t, db, 4, 5)
+	db.sinks.Start()
+	waitDelivered(t, q)
+	db.sinks.Stop()
+
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open sink file failed:%v", err)
+	}
+	defer fp.Close()
+	i := 0
+	for scanner := bufio.NewScanner(fp); scanner.Scan(); i++ {
+		var rec Record
+		if err = json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec.Key != fmt.Sprintf("uid:%d", i+1) {
+			t.Errorf("line %d is %s, %v", i, scanner.Text(), err)
+		}
+	}
+	if i != 5 {
+		t.Errorf("expect 5 records delivered, got %d", i)
+	}
+}
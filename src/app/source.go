@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"redis"
+)
+
+// a redis database persisted into its own leveldb
+type SourceConfig struct {
+	Name   string
+	Redis  Redis
+	Dbname string // default <leveldb.dbname>-<name>, other leveldb options are shared
+	Sinks  []SinkConfig
+}
+
+func (c *Redis) setDefault() {
+	if c.ReplicaRetry <= 0 {
+		c.ReplicaRetry = 3
+	}
+	if c.ReplicaWait <= 0 {
+		c.ReplicaWait = 50
+	}
+}
+
+func (c *Redis) Connect() (cli *redis.Redis, err error) {
+	cli = redis.NewRedis(c.Host, c.Password, c.Db)
+	err = cli.Connect()
+	return
+}
+
+// the top level redis, leveldb and sinks make the only source if none is configured
+func setupSources(configs []SourceConfig) ([]SourceConfig, error) {
+	if len(configs) == 0 {
+		configs = []SourceConfig{{
+			Name:   "default",
+			Redis:  setting.Redis,
+			Dbname: setting.Leveldb.Dbname,
+			Sinks:  setting.Sinks,
+		}}
+	}
+	names := make(map[string]bool)
+	for i := range configs {
+		c := &configs[i]
+		if c.Name == "" {
+			return nil, errors.New("source without name")
+		}
+		// agent methods are addressed as <source>.<method>
+		if strings.Contains(c.Name, ".") {
+			return nil, fmt.Errorf("source name %s contains '.'", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate source:%s", c.Name)
+		}
+		names[c.Name] = true
+		if c.Dbname == "" {
+			c.Dbname = setting.Leveldb.Dbname + "-" + c.Name
+		}
+		if err := checkSinks(c.Sinks); err != nil {
+			return nil, fmt.Errorf("source %s: %v", c.Name, err)
+		}
+		c.Redis.setDefault()
+	}
+	return configs, nil
+}
+
+func (c *SourceConfig) leveldbConfig() *LeveldbConfig {
+	config := setting.Leveldb
+	config.Dbname = c.Dbname
+	return &config
+}
+
+// Source captures one redis database and persists it into its own leveldb
+type Source struct {
+	name       string
+	dbname     string
+	config     *Redis
+	db         *Leveldb
+	m          Capture
+	s          *StorerMgr
+	loader     *Loader
+	migrator   *Migrator
+	evictor    *Evictor
+	sync_queue chan *SyncTask
+}
+
+func NewSource(config *SourceConfig) *Source {
+	db := NewLeveldb(config.leveldbConfig())
+	if len(config.Sinks) > 0 {
+		db.sinks = NewSinkMgr(db, config.Sinks)
+		db.sinks.Start()
+	}
+
+	rc := &config.Redis
+	var m Capture
+	switch rc.Capture {
+	case "":
+		rc.Capture = CAPTURE_NOTIFICATION
+		m = NewMonitor(rc)
+	case CAPTURE_NOTIFICATION:
+		m = NewMonitor(rc)
+	case CAPTURE_STREAM:
+		rc.Stream.setDefault()
+		m = NewStreamCapture(rc)
+	case CAPTURE_POLL:
+		rc.Poll.setDefault()
+		m = NewPollCapture(rc)
+	default:
+		Panic("unknown capture mode:%s, source:%s", rc.Capture, config.Name)
+	}
+
+	src := &Source{
+		name:       config.Name,
+		dbname:     config.Dbname,
+		config:     rc,
+		db:         db,
+		m:          m,
+		s:          NewStorerMgr(db, rc, 5),
+		loader:     NewLoader(db, rc),
+		migrator:   NewMigrator(db),
+		sync_queue: make(chan *SyncTask, 1),
+	}
+	if setting.Evict.Interval > 0 {
+		src.evictor = NewEvictor(db, rc, &setting.Evict)
+	}
+	return src
+}
+
+func (src *Source) Start() {
+	go src.m.Start(src.sync_queue)
+	go src.s.Start(src.sync_queue)
+	if src.evictor != nil {
+		src.evictor.Start()
+	}
+	Info("start source:%s, redis:%s/%d", src.name, src.config.Host, src.config.Db)
+}
+
+// stop capturing and wait until every captured key is persisted
+func (src *Source) Stop() {
+	if src.evictor != nil {
+		src.evictor.Stop()
+		Error("wait evictor, source:%s", src.name)
+	}
+	src.migrator.Stop()
+	Error("wait migrator, source:%s", src.name)
+	src.m.Stop()
+	Error("wait capture, source:%s", src.name)
+	src.s.Stop()
+	Error("wait storer, source:%s", src.name)
+	if src.db.sinks != nil {
+		src.db.sinks.Stop()
+		Error("wait sinks, source:%s", src.name)
+	}
+}
+
+func (src *Source) Close() {
+	src.db.Close()
+}
+
+// a copy of context sharing everything but the source, nil if there is no such source
+func (context *Context) withSource(name string) *Context {
+	for _, src := range context.sources {
+		if src.name == name {
+			ctx := *context
+			ctx.Source = src
+			return &ctx
+		}
+	}
+	return nil
+}
+
+func sources(ud interface{}, args []string) (result string, err error) {
+	context := ud.(*Context)
+	buf := bytes.NewBufferString("sources:\n")
+	for _, src := range context.sources {
+		current := ""
+		if src == context.Source {
+			current = " *"
+		}
+		fmt.Fprintf(buf, "%s: redis:%s/%d, capture:%s, leveldb:%s%s\n",
+			src.name, src.config.Host, src.config.Db, src.config.Capture, src.dbname, current)
+	}
+	result = buf.String()
+	return
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"strconv"
 	"sync"
 	"time"
@@ -9,9 +8,23 @@ import (
 	"redis"
 )
 
+// SyncTask asks storers to persist key, Done is called once it's committed.
+// Version is the version the writer expects to be persisted, if it's known.
+// Force persists it even if leveldb holds a newer version, e.g. for a key
+// deleted and created again with its version starting over
+type SyncTask struct {
+	Key     string
+	Done    func()
+	Version string
+	Force   bool
+}
+
 type Storer struct {
-	cli *redis.Redis
-	db  *Leveldb
+	config  *Redis
+	cli     *redis.Redis
+	replica *redis.Redis // nil if all reads go to the primary
+	broken  bool         // reconnect the replica before next read
+	db      *Leveldb
 }
 
 func (s *Storer) reconnect() {
@@ -36,70 +49,171 @@ func (s *Storer) reconnect() {
 	}
 }
 
-func (s *Storer) retry(key string, err error) {
+func (s *Storer) retry(task *SyncTask, err error) error {
 	Error("recv message failed, try to reconnect to redis:%v", err)
 	s.reconnect()
-	s.save(key)
+	return s.save(task)
 }
 
-func (s *Storer) expire(key string, resp map[string]string) {
-	value, ok := resp["expire"]
-	if !ok {
+// pttl is the remaining ttl in ms, negative if the key has no ttl
+func readHash(cli *redis.Redis, key string) (name string, resp map[string]string, pttl int, err error) {
+	if name, err = cli.Type(key); err != nil || name != "hash" {
 		return
 	}
-	seconds, err := strconv.Atoi(value)
-	if err != nil {
+	resp = make(map[string]string)
+	if err = cli.Hgetall(key, resp); err != nil {
+		return
+	}
+	var ret interface{}
+	if ret, err = cli.Exec("pttl", key); err != nil {
 		return
 	}
-	if seconds > 0 {
+	pttl, _ = ret.(int)
+	return
+}
+
+// a replica is stale if it lags behind the expected version, or the
+// persisted one when nothing is expected, like PutRecordIfNewer
+func replicaStale(version, expected, persisted string) bool {
+	if expected != "" {
+		return compareVersion(version, expected) < 0
+	}
+	return compareVersion(version, persisted) < 0
+}
+
+// read key from the replica, ok is false if the primary should be read instead
+func (s *Storer) readReplica(key, expected string) (name string, resp map[string]string, pttl int, ok bool) {
+	persisted := ""
+	if expected == "" {
+		version, err := s.db.Get([]byte(indexKey(key)))
+		if err != nil {
+			return
+		}
+		persisted = string(version)
+	}
+
+	for i := 0; i <= s.config.ReplicaRetry; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(s.config.ReplicaWait) * time.Millisecond)
+		}
+		var err error
+		if s.broken {
+			err = s.replica.ReConnect()
+		}
+		if err == nil {
+			name, resp, pttl, err = readHash(s.replica, key)
+		}
+		s.broken = err != nil
+		if err != nil {
+			Error("read key:%s from replica failed:%v", key, err)
+			return
+		}
+		if name == "hash" && !replicaStale(versionOf(resp), expected, persisted) {
+			ok = true
+			return
+		}
+	}
+	Info("replica lags on key:%s, read primary", key)
+	return
+}
+
+// seconds of the expire field if redis.expire is on, 0 if there is none
+func (s *Storer) expireSeconds(resp map[string]string) int {
+	if !s.config.Expire {
+		return 0
+	}
+	seconds, err := strconv.Atoi(resp["expire"])
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return seconds
+}
+
+func (s *Storer) expire(key string, resp map[string]string) {
+	if seconds := s.expireSeconds(resp); seconds > 0 {
 		Info("expire key:%s, seconds:%d", key, seconds)
 		s.cli.Exec("expire", key, seconds)
 	}
 }
 
-func (s *Storer) save(key string) {
-	name, err := s.cli.Type(key)
-	if err != nil {
-		s.retry(key, err)
-		return
+// return nil if the key is persisted or there is nothing to persist
+func (s *Storer) save(task *SyncTask) error {
+	key, expected := task.Key, task.Version
+	ns := namespaceOf(key)
+	if ns == nil || ns.Skip {
+		return nil
 	}
 
-	if name != "hash" {
-		Error("unexpected key type, key:%s, type:%s", key, name)
-		return
+	var name string
+	var resp map[string]string
+	var pttl int
+	ok := false
+	if s.replica != nil {
+		name, resp, pttl, ok = s.readReplica(key, expected)
 	}
-
-	resp := make(map[string]string)
-	err = s.cli.Hgetall(key, resp)
-	if err != nil {
-		s.retry(key, err)
-		return
+	if !ok {
+		var err error
+		if name, resp, pttl, err = readHash(s.cli, key); err != nil {
+			return s.retry(task, err)
+		}
 	}
 
-	chunk, err := json.Marshal(resp)
-	if err != nil {
-		Error("marshal obj failed, key:%s, obj:%v, err:%v", key, resp, err)
-		return
+	if name != "hash" {
+		switch {
+		case name == "none":
+			// deleted or expired since it was queued, leveldb keeps the last save
+			Info("skip key:%s, it doesn't exist any more", key)
+		case !ns.HasType(name):
+			Info("skip key:%s, type:%s isn't persisted in namespace:%s", key, name, ns.Name)
+		default:
+			Error("unexpected key type, key:%s, type:%s", key, name)
+		}
+		return nil
 	}
 
-	index_key := indexKey(key)
-	version := []byte(resp["version"])
-	err = s.db.BatchPut([]byte(index_key), version, []byte(key), chunk)
+	rec := &Record{
+		Key:       key,
+		Type:      name,
+		Version:   versionOf(resp),
+		Timestamp: time.Now().Unix(),
+		Fields:    ns.Fields.Persisted(resp),
+	}
+	// the ttl is the one set after the last save, not the application's
+	if s.expireSeconds(resp) > 0 {
+		pttl = -1
+	}
+	if pttl > 0 {
+		switch ns.Ttl {
+		case TTL_SKIP:
+			Info("skip volatile key:%s, namespace:%s", key, ns.Name)
+			return nil
+		case TTL_KEEP:
+			rec.ExpireAt = nowMs() + int64(pttl)
+		}
+	}
+	written := true
+	var err error
+	if task.Force {
+		Info("force save key:%s, version:%s", key, rec.Version)
+		err = s.db.PutRecord(rec)
+	} else {
+		written, err = s.db.PutRecordIfNewer(rec)
+	}
 	if err != nil {
 		Error("save key:%s failed, err:%v", key, err)
-		return
+		return err
 	}
-
-	// expire key
-	if setting.Redis.Expire {
-		s.expire(key, resp)
+	if !written {
+		return nil
 	}
 
-	Info("save key:%s, data len:%d", key, len(chunk))
-	return
+	s.expire(key, resp)
+
+	Info("save key:%s, fields:%d", key, len(rec.Fields))
+	return nil
 }
 
-func (s *Storer) Start(queue chan string, wg *sync.WaitGroup) {
+func (s *Storer) Start(queue chan *SyncTask, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	err := s.cli.Connect()
@@ -107,22 +221,35 @@ func (s *Storer) Start(queue chan string, wg *sync.WaitGroup) {
 		Panic("start Storer failed:%v", err)
 	}
 
+	if s.replica != nil {
+		if err = s.replica.Connect(); err != nil {
+			Error("connect replica failed, read primary until it's back:%v", err)
+			s.broken = true
+		}
+	}
+
 	Info("start storer succeed")
 
-	for key := range queue {
-		s.save(key)
+	for task := range queue {
+		if s.save(task) == nil && task.Done != nil {
+			task.Done()
+		}
 	}
 	Info("queue is closed, storer will exit")
 }
 
-func NewStorer(db *Leveldb) *Storer {
-	cli := redis.NewRedis(setting.Redis.Host, setting.Redis.Password, setting.Redis.Db)
-	return &Storer{cli, db}
+func NewStorer(db *Leveldb, config *Redis, replica string) *Storer {
+	cli := redis.NewRedis(config.Host, config.Password, config.Db)
+	s := &Storer{config: config, cli: cli, db: db}
+	if replica != "" {
+		s.replica = redis.NewRedis(replica, config.Password, config.Db)
+	}
+	return s
 }
 
 type StorerMgr struct {
 	instances []*Storer
-	queues    []chan string
+	queues    []chan *SyncTask
 	wg        sync.WaitGroup
 }
 
@@ -134,7 +261,7 @@ func _hash(str string) int {
 	return h
 }
 
-func (m *StorerMgr) Start(queue chan string) {
+func (m *StorerMgr) Start(queue chan *SyncTask) {
 	m.wg.Add(1)
 	defer m.wg.Done()
 
@@ -145,9 +272,9 @@ func (m *StorerMgr) Start(queue chan string) {
 
 	// dispatch msg
 	max := len(m.queues)
-	for key := range queue {
-		i := _hash(key) % max
-		m.queues[i] <- key
+	for task := range queue {
+		i := _hash(task.Key) % max
+		m.queues[i] <- task
 	}
 
 	Info("queue is closed, all storer will exit")
@@ -160,13 +287,18 @@ func (m *StorerMgr) Stop() {
 	m.wg.Wait()
 }
 
-func NewStorerMgr(db *Leveldb, numInstances int) *StorerMgr {
+func NewStorerMgr(db *Leveldb, config *Redis, numInstances int) *StorerMgr {
 	m := new(StorerMgr)
 	m.instances = make([]*Storer, numInstances)
-	m.queues = make([]chan string, numInstances)
+	m.queues = make([]chan *SyncTask, numInstances)
 	for i := 0; i < numInstances; i++ {
-		m.instances[i] = NewStorer(db)
-		m.queues[i] = make(chan string, 256)
+		// spread storers over replicas
+		replica := ""
+		if n := len(config.Replicas); n > 0 {
+			replica = config.Replicas[i%n]
+		}
+		m.instances[i] = NewStorer(db, config, replica)
+		m.queues[i] = make(chan *SyncTask, 256)
 	}
 	return m
 }
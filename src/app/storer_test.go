@@ -0,0 +1,173 @@
+package main
+
+import (
+	"testing"
+)
+
+// use the given version config until the test ends
+func setVersion(t *testing.T, config VersionConfig) {
+	old := setting.Version
+	if err := config.setDefault(); err != nil {
+		t.Fatalf("invalid version config:%v", err)
+	}
+	setting.Version = config
+	t.Cleanup(func() { setting.Version = old })
+}
+
+func TestReplicaStale(t *testing.T) {
+	setVersion(t, VersionConfig{})
+	cases := []struct {
+		version, expected, persisted string
+		stale                        bool
+	}{
+		// the writer tells which version to wait for
+		{"5", "5", "", false},
+		{"6", "5", "", false},
+		{"4", "5", "", true},
+		{"", "5", "", true},
+		// otherwise the replica mustn't be older than leveldb
+		{"5", "", "4", false},
+		{"5", "", "5", false},
+		{"4", "", "5", true},
+		{"1", "", "", false},
+		{"", "", "", false},
+		{"", "", "5", true},
+		{"10", "", "9", false},
+	}
+	for _, c := range cases {
+		if stale := replicaStale(c.version, c.expected, c.persisted); stale != c.stale {
+			t.Errorf("version:%q, expected:%q, persisted:%q, expect stale:%v",
+				c.version, c.expected, c.persisted, c.stale)
+		}
+	}
+}
+
+// use the given namespaces until the test ends
+func setNamespaces(t *testing.T, configs []NamespaceConfig) {
+	old := setting.Namespaces
+	namespaces, err := setupNamespaces(configs)
+	if err != nil {
+		t.Fatalf("invalid namespaces:%v", err)
+	}
+	setting.Namespaces = namespaces
+	t.Cleanup(func() { setting.Namespaces = old })
+}
+
+func startTestStorer(t *testing.T, db *Leveldb, config *Redis) *Storer {
+	s := NewStorer(db, config, "")
+	if err := s.cli.Connect(); err != nil {
+		t.Fatalf("connect failed:%v", err)
+	}
+	t.Cleanup(s.cli.Close)
+	return s
+}
+
+// ttls the daemon sets itself, by redis.expire or a load ttl, must not be
+// persisted as the key's own, or the record would be skipped once they pass
+func TestDaemonTtlNotPersisted(t *testing.T) {
+	setVersion(t, VersionConfig{})
+	setNamespaces(t, []NamespaceConfig{
+		{Name: "user", Pattern: "uid:*", Ttl: TTL_KEEP},
+		{Name: "session", Pattern: "sess:*", Ttl: TTL_SKIP},
+		{Name: "default", Pattern: "*"},
+	})
+	r := startFakeRedis(t)
+	db := newTestLeveldb(t, nil)
+	config := &Redis{Host: r.Addr(), Expire: true, LoadTtl: 60}
+	config.setDefault()
+	s := startTestStorer(t, db, config)
+	cli, _ := config.Connect()
+	defer cli.Close()
+
+	save := func(key string) *Record {
+		if err := s.save(&SyncTask{Key: key}); err != nil {
+			t.Fatalf("save %s failed:%v", key, err)
+		}
+		rec, err := db.GetRecord(key)
+		if err != nil || rec == nil {
+			t.Fatalf("get %s failed:%v, %v", key, rec, err)
+		}
+		return rec
+	}
+
+	for _, key := range []string{"uid:1", "sess:1", "item:1"} {
+		// save, then the daemon expires the key by its expire field
+		r.Hset(key, map[string]string{"version": "1", "expire": "100"})
+		if rec := save(key); rec.ExpireAt != 0 {
+			t.Errorf("%s: first save has ttl", key)
+		}
+		if pttl := r.Pttl(key); pttl <= 0 {
+			t.Fatalf("%s: not expired by the daemon, pttl:%d", key, pttl)
+		}
+
+		// the next write sees the daemon's ttl
+		r.Hset(key, map[string]string{"version": "2"})
+		if rec := save(key); rec.Version != "2" || rec.ExpireAt != 0 {
+			t.Errorf("%s: daemon ttl persisted, record:%#v", key, rec)
+		}
+
+		// evicted, then loaded back with the load ttl where the namespace allows it
+		r.Del(key)
+		loaded, err := load(db, key, config.LoadTtl, cli)
+		if err != nil || !loaded {
+			t.Fatalf("%s: load failed:%v, %v", key, loaded, err)
+		}
+		pttl := r.Pttl(key)
+		if key == "item:1" {
+			if pttl <= 0 {
+				t.Errorf("%s: load ttl not applied", key)
+			}
+		} else if pttl != -1 {
+			t.Errorf("%s: load ttl applied in a %s namespace", key, namespaceOf(key).Ttl)
+		}
+
+		r.Hset(key, map[string]string{"version": "3"})
+		if rec := save(key); rec.Version != "3" || rec.ExpireAt != 0 {
+			t.Errorf("%s: write after load lost its record or ttl, record:%#v", key, rec)
+		}
+	}
+
+	// the application's own ttl is still kept
+	r.Hset("uid:2", map[string]string{"version": "1"})
+	r.Pexpire("uid:2", 100000)
+	if rec := save("uid:2"); rec.Ttl() <= 0 || rec.Ttl() > 100000 {
+		t.Errorf("application ttl lost, record:%#v", rec)
+	}
+	r.Del("uid:2")
+	if loaded, err := load(db, "uid:2", config.LoadTtl, cli); err != nil || !loaded {
+		t.Fatalf("load uid:2 failed:%v, %v", loaded, err)
+	}
+	if pttl := r.Pttl("uid:2"); pttl <= 60000 || pttl > 100000 {
+		t.Errorf("persisted ttl not applied on load, pttl:%d", pttl)
+	}
+}
+
+// a key deleted after it was queued is skipped, the last save is kept
+func TestSaveDeletedKey(t *testing.T) {
+	setVersion(t, VersionConfig{})
+	setNamespaces(t, nil)
+	r := startFakeRedis(t)
+	db := newTestLeveldb(t, nil)
+	config := &Redis{Host: r.Addr()}
+	config.setDefault()
+	s := startTestStorer(t, db, config)
+
+	if err := s.save(&SyncTask{Key: "uid:404"}); err != nil {
+		t.Errorf("save missing key failed:%v", err)
+	}
+	if rec, _ := db.GetRecord("uid:404"); rec != nil {
+		t.Errorf("missing key persisted:%v", rec)
+	}
+
+	r.Hset("uid:1", map[string]string{"version": "1"})
+	if err := s.save(&SyncTask{Key: "uid:1"}); err != nil {
+		t.Fatalf("save failed:%v", err)
+	}
+	r.Del("uid:1")
+	if err := s.save(&SyncTask{Key: "uid:1"}); err != nil {
+		t.Errorf("save deleted key failed:%v", err)
+	}
+	if rec, _ := db.GetRecord("uid:1"); rec == nil || rec.Version != "1" {
+		t.Errorf("last save lost:%v", rec)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"redis"
+)
+
+const (
+	CAPTURE_NOTIFICATION = "notification"
+	CAPTURE_STREAM       = "stream"
+)
+
+// the application xadds dirty keys to a stream, e.g. XADD dirty * key uid:1
+type StreamConfig struct {
+	Name         string
+	Group        string // default redis-persist
+	Consumer     string // default hostname, keep it stable to reclaim own entries after restart
+	KeyField     string // field of the entry holding the key, default key
+	VersionField string // optional field of the entry holding the written version, default version
+	Batch        int    // entries per read, default 100
+	Block        int    // ms, default 1000
+	ClaimIdle    int    // ms, claim entries pending longer than this, default 60000
+}
+
+func (c *StreamConfig) setDefault() {
+	if c.Group == "" {
+		c.Group = "redis-persist"
+	}
+	if c.Consumer == "" {
+		c.Consumer, _ = os.Hostname()
+	}
+	if c.KeyField == "" {
+		c.KeyField = "key"
+	}
+	if c.VersionField == "" {
+		c.VersionField = "version"
+	}
+	if c.Batch <= 0 {
+		c.Batch = 100
+	}
+	if c.Block <= 0 {
+		c.Block = 1000
+	}
+	if c.ClaimIdle <= 0 {
+		c.ClaimIdle = 60000
+	}
+}
+
+// capture by a stream consumer group, an entry is acked only after its key is
+// persisted, so nothing is lost across disconnects and restarts
+type StreamCapture struct {
+	cli    *redis.Redis
+	config *StreamConfig
+	mu     sync.Mutex
+	acks   []interface{}
+	quit   chan bool
+	done   chan bool
+}
+
+func (sc *StreamCapture) ack(id string) {
+	sc.mu.Lock()
+	sc.acks = append(sc.acks, id)
+	sc.mu.Unlock()
+}
+
+func (sc *StreamCapture) flushAcks() error {
+	sc.mu.Lock()
+	ids := sc.acks
+	sc.acks = nil
+	sc.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	args := append([]interface{}{sc.config.Name, sc.config.Group}, ids...)
+	if _, err := sc.cli.Exec("xack", args...); err != nil {
+		// put them back for the next flush
+		sc.mu.Lock()
+		sc.acks = append(sc.acks, ids...)
+		sc.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (sc *StreamCapture) createGroup() error {
+	// consume from the beginning if the group is new
+	_, err := sc.cli.Exec("xgroup", "create", sc.config.Name, sc.config.Group, "0", "mkstream")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	Info("consume stream:%s, group:%s, consumer:%s", sc.config.Name, sc.config.Group, sc.config.Consumer)
+	return nil
+}
+
+func (sc *StreamCapture) dispatch(queue chan *SyncTask, entries interface{}) int {
+	items, _ := entries.([]interface{})
+	for _, item := range items {
+		entry, ok := item.([]interface{})
+		if !ok || len(entry) != 2 {
+			Error("receive unexpected stream entry, %v", item)
+			continue
+		}
+		id, _ := entry[0].(string)
+		fields, _ := entry[1].([]string)
+		key, version := "", ""
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i] {
+			case sc.config.KeyField:
+				key = fields[i+1]
+			case sc.config.VersionField:
+				version = fields[i+1]
+			}
+		}
+		if key == "" {
+			// deleted or malformed entry, nothing to persist
+			Error("stream entry:%s has no %s, ack it", id, sc.config.KeyField)
+			sc.ack(id)
+			continue
+		}
+		Info("receive stream entry:%s, key:%s", id, key)
+		queue <- &SyncTask{Key: key, Done: func() { sc.ack(id) }, Version: version}
+	}
+	return len(items)
+}
+
+// claim entries which are delivered but not acked for a while, including
+// those of this consumer before restart
+func (sc *StreamCapture) claim(queue chan *SyncTask) error {
+	cursor := "0-0"
+	for {
+		resp, err := sc.cli.Exec("xautoclaim", sc.config.Name, sc.config.Group, sc.config.Consumer,
+			sc.config.ClaimIdle, cursor, "count", sc.config.Batch)
+		if err != nil {
+			return err
+		}
+		// [cursor, [[id, [field, value, ...]], ...], [deleted id, ...]]
+		reply, ok := resp.([]interface{})
+		if !ok || len(reply) < 2 {
+			Error("receive unexpected xautoclaim reply, %v", resp)
+			return nil
+		}
+		if n := sc.dispatch(queue, reply[1]); n > 0 {
+			Info("claim %d stale stream entries", n)
+		}
+		cursor, _ = reply[0].(string)
+		if cursor == "" || cursor == "0-0" {
+			return nil
+		}
+	}
+}
+
+func (sc *StreamCapture) read(queue chan *SyncTask) error {
+	resp, err := sc.cli.Exec("xreadgroup", "group", sc.config.Group, sc.config.Consumer,
+		"count", sc.config.Batch, "block", sc.config.Block, "streams", sc.config.Name, ">")
+	if err != nil || resp == nil {
+		return err
+	}
+	// [[stream, [[id, [field, value, ...]], ...]]]
+	streams, _ := resp.([]interface{})
+	for _, item := range streams {
+		if stream, ok := item.([]interface{}); ok && len(stream) == 2 {
+			sc.dispatch(queue, stream[1])
+		}
+	}
+	return nil
+}
+
+func (sc *StreamCapture) reconnect() bool {
+	times := 0
+	for {
+		wait := times
+		times = times + 1
+		if wait > 30 {
+			wait = 30
+		}
+		Info("try to reconnect stream capture, times:%d, wait:%d", times, wait)
+		select {
+		case <-sc.quit:
+			return false
+		case <-time.After(time.Duration(wait) * time.Second):
+		}
+
+		if err := sc.cli.ReConnect(); err != nil {
+			Error("reconnect stream capture failed:%v", err)
+			continue
+		}
+		if err := sc.createGroup(); err != nil {
+			Error("create stream group failed:%v", err)
+			continue
+		}
+		return true
+	}
+}
+
+func (sc *StreamCapture) Start(queue chan *SyncTask) {
+	defer close(sc.done)
+	defer close(queue)
+
+	if err := sc.cli.Connect(); err != nil {
+		Panic("start stream capture failed:%v", err)
+	}
+	if err := sc.createGroup(); err != nil {
+		Panic("start stream capture failed:%v", err)
+	}
+	Info("start stream capture succeed")
+
+	claim_interval := time.Duration(sc.config.ClaimIdle) * time.Millisecond
+	var last_claim time.Time
+	for {
+		select {
+		case <-sc.quit:
+			if err := sc.flushAcks(); err != nil {
+				Error("ack stream entries failed, they will be claimed again:%v", err)
+			}
+			sc.cli.Close()
+			return
+		default:
+		}
+
+		err := sc.flushAcks()
+		if err == nil && time.Since(last_claim) >= claim_interval {
+			err = sc.claim(queue)
+			last_claim = time.Now()
+		}
+		if err == nil {
+			err = sc.read(queue)
+		}
+		if err != nil {
+			Error("consume stream failed, try to reconnect to redis:%v", err)
+			if !sc.reconnect() {
+				return
+			}
+		}
+	}
+}
+
+func (sc *StreamCapture) Stop() {
+	close(sc.quit)
+	<-sc.done
+}
+
+func NewStreamCapture(source *Redis) *StreamCapture {
+	cli := redis.NewRedis(source.Host, source.Password, source.Db)
+	return &StreamCapture{
+		cli:    cli,
+		config: &source.Stream,
+		quit:   make(chan bool),
+		done:   make(chan bool),
+	}
+}
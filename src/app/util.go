@@ -1,16 +1,24 @@
 package main
 
-const INDEX_KEY_PREFIX string = "|"
-const INDEX_KEY_LEN int = len("|")
+// Internal entries live under INTERNAL_PREFIX and records under DATA_PREFIX,
+// so no redis key can collide with them
+const INTERNAL_PREFIX string = "\x00"
+const DATA_PREFIX string = "\x01"
 
-var INDEX_KEY_START = []byte("|")
-var INDEX_KEY_END = []byte{'|', 0xff}
+var DATA_KEY_START = []byte(DATA_PREFIX)
+var DATA_KEY_LIMIT = []byte("\x02") // exclusive
 
-const KEY_PREFIX string = "uid:"
+// version index entry: INTERNAL_PREFIX '|' key => version
+const INDEX_KEY_PREFIX string = INTERNAL_PREFIX + "|"
+const INDEX_KEY_LEN int = len(INDEX_KEY_PREFIX)
 
-var KEY_START = []byte("uid:")
-var KEY_END = []byte{'u', 'i', 'd', ':', 0xff}
+var INDEX_KEY_START = []byte(INDEX_KEY_PREFIX)
+var INDEX_KEY_END = []byte(INDEX_KEY_PREFIX + "\xff")
 
 func indexKey(key string) string {
 	return INDEX_KEY_PREFIX + key
 }
+
+func dataKey(key string) []byte {
+	return []byte(DATA_PREFIX + key)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"redis"
+)
+
+const (
+	VERSION_INTEGER       = "integer"
+	VERSION_TIMESTAMP     = "timestamp" // unix time in any unit, or rfc3339
+	VERSION_LEXICOGRAPHIC = "lexicographic"
+)
+
+const (
+	CONFLICT_NEWER_WINS   = "newer-wins"
+	CONFLICT_LEVELDB_WINS = "leveldb-wins"
+	CONFLICT_REDIS_WINS   = "redis-wins"
+	CONFLICT_MERGE_FIELDS = "merge-fields"
+)
+
+var conflictPolicies = []string{CONFLICT_NEWER_WINS, CONFLICT_LEVELDB_WINS, CONFLICT_REDIS_WINS, CONFLICT_MERGE_FIELDS}
+
+// hmset ARGV[2..] into KEYS[1], unpack fails above ~8000 values on the lua stack
+const HMSET_ARGV string = `
+for i = 2, #ARGV, 2000 do
+	redis.call('hmset', KEYS[1], unpack(ARGV, i, math.min(i + 1999, #ARGV)))
+end
+`
+
+// replace KEYS[1] with the hash in ARGV[2..], expire in ARGV[1] ms if it's positive
+const REPLACE_SCRIPT string = `
+redis.call('del', KEYS[1])
+` + HMSET_ARGV + `
+local pttl = tonumber(ARGV[1])
+if pttl > 0 then
+	redis.call('pexpire', KEYS[1], pttl)
+end
+return 1
+`
+
+type VersionConfig struct {
+	Field    string // default version
+	Type     string // integer (default), timestamp or lexicographic
+	Conflict string // default restore policy, newer-wins (default), leveldb-wins, redis-wins or merge-fields
+}
+
+func (c *VersionConfig) setDefault() error {
+	if c.Field == "" {
+		c.Field = "version"
+	}
+	switch c.Type {
+	case "":
+		c.Type = VERSION_INTEGER
+	case VERSION_INTEGER, VERSION_TIMESTAMP, VERSION_LEXICOGRAPHIC:
+	default:
+		return fmt.Errorf("unknown version type: %s", c.Type)
+	}
+	if c.Conflict == "" {
+		c.Conflict = CONFLICT_NEWER_WINS
+	}
+	return checkPolicy(c.Conflict)
+}
+
+func checkPolicy(policy string) error {
+	for _, p := range conflictPolicies {
+		if p == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown conflict policy: %s", policy)
+}
+
+type ConflictStats struct {
+	StaleWrites uint64 `json:"stale_writes"` // saves rejected for an older version
+	Conflicts   uint64 `json:"conflicts"`    // restores finding different data in redis
+	LeveldbWins uint64 `json:"leveldb_wins"`
+	RedisWins   uint64 `json:"redis_wins"`
+	Merged      uint64 `json:"merged"`
+}
+
+func (s *ConflictStats) Snapshot() ConflictStats {
+	return ConflictStats{
+		StaleWrites: atomic.LoadUint64(&s.StaleWrites),
+		Conflicts:   atomic.LoadUint64(&s.Conflicts),
+		LeveldbWins: atomic.LoadUint64(&s.LeveldbWins),
+		RedisWins:   atomic.LoadUint64(&s.RedisWins),
+		Merged:      atomic.LoadUint64(&s.Merged),
+	}
+}
+
+func versionOf(fields map[string]string) string {
+	return fields[setting.Version.Field]
+}
+
+func parseTimestamp(v string) (int64, bool) {
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		// normalize seconds, ms and us of recent dates to ns
+		for n > 0 && n < 9e15 {
+			n *= 1000
+		}
+		return n, true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t.UnixNano(), true
+	}
+	return 0, false
+}
+
+// -1, 0 or 1 as a is older, equal or newer than b, a missing version is the
+// oldest, versions which can't be parsed as the type are compared as strings
+func compareVersion(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return -1
+	}
+	if b == "" {
+		return 1
+	}
+
+	var x, y int64
+	ok := false
+	switch setting.Version.Type {
+	case VERSION_INTEGER:
+		var err1, err2 error
+		x, err1 = strconv.ParseInt(a, 10, 64)
+		y, err2 = strconv.ParseInt(b, 10, 64)
+		ok = err1 == nil && err2 == nil
+	case VERSION_TIMESTAMP:
+		var ok1, ok2 bool
+		x, ok1 = parseTimestamp(a)
+		y, ok2 = parseTimestamp(b)
+		ok = ok1 && ok2
+	}
+	if !ok {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// write rec unless leveldb holds a newer version, written is false if rejected
+func (self *Leveldb) PutRecordIfNewer(rec *Record) (written bool, err error) {
+	l := self.Lock(rec.Key)
+	defer l.Unlock()
+
+	persisted, err := self.Get([]byte(indexKey(rec.Key)))
+	if err != nil {
+		return
+	}
+	if persisted != nil && compareVersion(rec.Version, string(persisted)) < 0 {
+		atomic.AddUint64(&self.conflicts.StaleWrites, 1)
+		Error("reject stale write, key:%s, version:%s < persisted:%s, sync it with force if the key was recreated",
+			rec.Key, rec.Version, string(persisted))
+		return
+	}
+	if err = self.putRecord(rec); err != nil {
+		return
+	}
+	written = true
+	return
+}
+
+func sameFields(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// union of both, the newer side wins fields present on both
+func mergeFields(redis_data, leveldb_data map[string]string) map[string]string {
+	newer, older := leveldb_data, redis_data
+	if compareVersion(versionOf(redis_data), versionOf(leveldb_data)) >= 0 {
+		newer, older = redis_data, leveldb_data
+	}
+	merged := make(map[string]string, len(newer)+len(older))
+	for k, v := range older {
+		merged[k] = v
+	}
+	for k, v := range newer {
+		merged[k] = v
+	}
+	return merged
+}
+
+// resolve leveldb_data against redis_data, return nil if redis should be kept
+func (s *ConflictStats) resolve(policy string, redis_data, leveldb_data map[string]string) map[string]string {
+	if len(redis_data) == 0 {
+		return leveldb_data
+	}
+	if sameFields(redis_data, leveldb_data) {
+		return nil
+	}
+
+	atomic.AddUint64(&s.Conflicts, 1)
+	switch policy {
+	case CONFLICT_LEVELDB_WINS:
+	case CONFLICT_REDIS_WINS:
+		atomic.AddUint64(&s.RedisWins, 1)
+		return nil
+	case CONFLICT_MERGE_FIELDS:
+		atomic.AddUint64(&s.Merged, 1)
+		return mergeFields(redis_data, leveldb_data)
+	default:
+		if compareVersion(versionOf(redis_data), versionOf(leveldb_data)) >= 0 {
+			atomic.AddUint64(&s.RedisWins, 1)
+			return nil
+		}
+	}
+	atomic.AddUint64(&s.LeveldbWins, 1)
+	return leveldb_data
+}
+
+// pttl in ms, no expiry if it's not positive
+func replaceHash(cli *redis.Redis, key string, fields map[string]string, pttl int64) error {
+	_, err := cli.Exec("eval", hashArgs(fields, REPLACE_SCRIPT, 1, key, int(pttl))...)
+	return err
+}
+
+// restore policy argument, the configured one if empty
+func restorePolicy(arg string) (string, error) {
+	if arg == "" {
+		return setting.Version.Conflict, nil
+	}
+	return arg, checkPolicy(arg)
+}
+
+func conflicts(ud interface{}, args []string) (result string, err error) {
+	context := ud.(*Context)
+	stats := context.db.conflicts.Snapshot()
+	buf := bytes.NewBufferString("conflicts:\n")
+	fmt.Fprintf(buf, "version: %s(%s), policy: %s\n", setting.Version.Field, setting.Version.Type, setting.Version.Conflict)
+	fmt.Fprintf(buf, "stale writes: %d\n", stats.StaleWrites)
+	fmt.Fprintf(buf, "restore conflicts: %d, leveldb wins: %d, redis wins: %d, merged: %d\n",
+		stats.Conflicts, stats.LeveldbWins, stats.RedisWins, stats.Merged)
+	result = buf.String()
+	return
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	const ns int64 = 1700000000 * 1e9
+	for _, v := range []string{"1700000000", "1700000000000", "1700000000000000", "1700000000000000000",
+		"2023-11-14T22:13:20Z", "2023-11-15T06:13:20+08:00"} {
+		if n, ok := parseTimestamp(v); !ok || n != ns {
+			t.Errorf("parse %s, expect %d, got %d, %v", v, ns, n, ok)
+		}
+	}
+	if n, ok := parseTimestamp("2023-11-14T22:13:20.5Z"); !ok || n != ns+5e8 {
+		t.Errorf("parse fraction, got %d, %v", n, ok)
+	}
+	for _, v := range []string{"", "abc", "2023-11-14"} {
+		if _, ok := parseTimestamp(v); ok {
+			t.Errorf("parse %q succeed", v)
+		}
+	}
+}
+
+func TestCompareVersion(t *testing.T) {
+	cases := []struct {
+		typ    string
+		a, b   string
+		result int
+	}{
+		{VERSION_INTEGER, "9", "10", -1},
+		{VERSION_INTEGER, "10", "9", 1},
+		{VERSION_INTEGER, "010", "10", 0},
+		{VERSION_INTEGER, "", "1", -1},
+		{VERSION_INTEGER, "1", "", 1},
+		{VERSION_INTEGER, "", "", 0},
+		{VERSION_INTEGER, "a", "b", -1},
+		{VERSION_INTEGER, "9", "a", -1},
+		{VERSION_TIMESTAMP, "1700000000", "1700000000001", -1},
+		{VERSION_TIMESTAMP, "1700000000", "1700000000000", 0},
+		{VERSION_TIMESTAMP, "2023-11-14T22:13:21Z", "1700000000000", 1},
+		{VERSION_LEXICOGRAPHIC, "9", "10", 1},
+		{VERSION_LEXICOGRAPHIC, "a", "b", -1},
+	}
+	for _, c := range cases {
+		setVersion(t, VersionConfig{Type: c.typ})
+		if result := compareVersion(c.a, c.b); result != c.result {
+			t.Errorf("%s: compare %q with %q, expect %d, got %d", c.typ, c.a, c.b, c.result, result)
+		}
+	}
+}
+
+func TestMergeFields(t *testing.T) {
+	setVersion(t, VersionConfig{})
+	older := map[string]string{"version": "1", "a": "old", "b": "b"}
+	newer := map[string]string{"version": "2", "a": "new", "c": "c"}
+	expect := map[string]string{"version": "2", "a": "new", "b": "b", "c": "c"}
+	if merged := mergeFields(older, newer); !reflect.DeepEqual(merged, expect) {
+		t.Errorf("leveldb newer, got %v", merged)
+	}
+	if merged := mergeFields(newer, older); !reflect.DeepEqual(merged, expect) {
+		t.Errorf("redis newer, got %v", merged)
+	}
+
+	// redis wins a tie
+	tie := map[string]string{"version": "2", "a": "tie"}
+	if merged := mergeFields(tie, newer); merged["a"] != "tie" || merged["c"] != "c" {
+		t.Errorf("tie, got %v", merged)
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	setVersion(t, VersionConfig{})
+	old := map[string]string{"version": "1", "a": "old"}
+	cur := map[string]string{"version": "2", "a": "new"}
+	merged := map[string]string{"version": "2", "a": "new"}
+
+	cases := []struct {
+		policy        string
+		redis, stored map[string]string
+		result        map[string]string
+	}{
+		// a missing key is always restored, the same data never is
+		{CONFLICT_REDIS_WINS, nil, old, old},
+		{CONFLICT_LEVELDB_WINS, cur, cur, nil},
+		{CONFLICT_NEWER_WINS, old, cur, cur},
+		{CONFLICT_NEWER_WINS, cur, old, nil},
+		{CONFLICT_NEWER_WINS, map[string]string{"version": "2"}, cur, nil},
+		{CONFLICT_LEVELDB_WINS, cur, old, old},
+		{CONFLICT_REDIS_WINS, old, cur, nil},
+		{CONFLICT_MERGE_FIELDS, old, cur, merged},
+	}
+	var stats ConflictStats
+	for _, c := range cases {
+		if result := stats.resolve(c.policy, c.redis, c.stored); !reflect.DeepEqual(result, c.result) {
+			t.Errorf("%s: redis %v, leveldb %v, expect %v, got %v", c.policy, c.redis, c.stored, c.result, result)
+		}
+	}
+	expect := ConflictStats{Conflicts: 6, LeveldbWins: 2, RedisWins: 3, Merged: 1}
+	if stats.Snapshot() != expect {
+		t.Errorf("stats %+v, expect %+v", stats.Snapshot(), expect)
+	}
+}
+
+func TestPutRecordIfNewer(t *testing.T) {
+	setVersion(t, VersionConfig{})
+	db := newTestLeveldb(t, nil)
+	put := func(version string) bool {
+		written, err := db.PutRecordIfNewer(&Record{Key: "k", Version: version, Fields: map[string]string{"version": version}})
+		if err != nil {
+			t.Fatalf("put failed:%v", err)
+		}
+		return written
+	}
+	if !put("5") || !put("5") || !put("6") {
+		t.Errorf("newer or equal version rejected")
+	}
+	if put("1") || put("") {
+		t.Errorf("older version written")
+	}
+	// stale writes are counted per source
+	if n := db.conflicts.Snapshot().StaleWrites; n != 2 {
+		t.Errorf("%d stale writes, expect 2", n)
+	}
+	if n := newTestLeveldb(t, nil).conflicts.Snapshot().StaleWrites; n != 0 {
+		t.Errorf("%d stale writes of another source", n)
+	}
+
+	// a recreated key is persisted by a forced sync, later writes compare with it
+	if err := db.PutRecord(&Record{Key: "k", Version: "1", Fields: map[string]string{"version": "1"}}); err != nil {
+		t.Fatalf("force put failed:%v", err)
+	}
+	if !put("2") {
+		t.Errorf("write after forced sync rejected")
+	}
+}
@@ -86,27 +86,29 @@ func readResponse(reader *bufio.Reader) (interface{}, error) {
 		if sz < 0 {
 			return nil, nil
 		}
-		var ret = make([]string, sz)
+		// flat arrays are returned as []string, nested ones (e.g. xreadgroup) as []interface{}
+		var items = make([]interface{}, sz)
+		var flat = true
 		for i := 0; i < sz; i++ {
-			nextline, err := reader.ReadString('\n')
-			// log.Printf("header:%s", nextline)
+			item, err := readResponse(reader)
 			if err != nil {
 				return nil, err
 			}
-			nextcontent := nextline[1 : len(nextline)-2]
-			if nextline[0] == ':' {
-				ret[i] = nextcontent
-			} else if nextline[0] == '$' {
-				sz, _ := strconv.Atoi(nextcontent)
-				s, err := readBulkString(reader, sz)
-				if err != nil {
-					return nil, err
-				}
-				ret[i] = s
-			} else {
-				log.Printf("unexpected response(*): %s", nextline)
-				return nil, MalformedResponse
+			switch v := item.(type) {
+			case string:
+			case int:
+				item = strconv.Itoa(v)
+			default:
+				flat = false
 			}
+			items[i] = item
+		}
+		if !flat {
+			return items, nil
+		}
+		var ret = make([]string, sz)
+		for i, item := range items {
+			ret[i] = item.(string)
 		}
 		return ret, nil
 	}
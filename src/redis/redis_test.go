@@ -1,6 +1,11 @@
 package redis
 
-import "testing"
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestRedis(t *testing.T) {
 	cli := NewRedis("127.0.0.1:6300", "foobared", 2)
@@ -14,3 +19,68 @@ func TestRedis(t *testing.T) {
 		t.Errorf("hgetall failed:%v", err)
 	}
 }
+
+func parse(t *testing.T, data string) interface{} {
+	resp, err := readResponse(bufio.NewReader(strings.NewReader(data)))
+	if err != nil {
+		t.Fatalf("read %q failed:%v", data, err)
+	}
+	return resp
+}
+
+func TestReadResponseFlatArray(t *testing.T) {
+	resp := parse(t, "*3\r\n$1\r\na\r\n:2\r\n+ok\r\n")
+	if !reflect.DeepEqual(resp, []string{"a", "2", "ok"}) {
+		t.Errorf("unexpected flat array:%#v", resp)
+	}
+}
+
+func TestReadResponseNestedArray(t *testing.T) {
+	// xreadgroup: [[stream, [[id, [field, value]]]]]
+	data := "*1\r\n*2\r\n$1\r\ns\r\n*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n"
+	expect := []interface{}{
+		[]interface{}{"s", []interface{}{
+			[]interface{}{"1-0", []string{"f", "v"}},
+		}},
+	}
+	if resp := parse(t, data); !reflect.DeepEqual(resp, expect) {
+		t.Errorf("unexpected nested array:%#v", resp)
+	}
+}
+
+func TestReadResponseNilArray(t *testing.T) {
+	if resp := parse(t, "*-1\r\n"); resp != nil {
+		t.Errorf("nil array read as %#v", resp)
+	}
+
+	// a nil element makes the array nested
+	resp := parse(t, "*2\r\n$1\r\na\r\n*-1\r\n")
+	if !reflect.DeepEqual(resp, []interface{}{"a", nil}) {
+		t.Errorf("unexpected array with nil element:%#v", resp)
+	}
+}
+
+func TestReadResponseNilBulk(t *testing.T) {
+	resp := parse(t, "*2\r\n$-1\r\n$1\r\nb\r\n")
+	if !reflect.DeepEqual(resp, []string{"", "b"}) {
+		t.Errorf("unexpected array with nil bulk:%#v", resp)
+	}
+}
+
+func TestReadResponseEmptyArray(t *testing.T) {
+	if resp := parse(t, "*0\r\n"); !reflect.DeepEqual(resp, []string{}) {
+		t.Errorf("empty array read as %#v", resp)
+	}
+
+	resp := parse(t, "*2\r\n*0\r\n$1\r\na\r\n")
+	if !reflect.DeepEqual(resp, []interface{}{[]string{}, "a"}) {
+		t.Errorf("unexpected array with empty element:%#v", resp)
+	}
+}
+
+func TestReadResponseError(t *testing.T) {
+	_, err := readResponse(bufio.NewReader(strings.NewReader("-ERR no such key\r\n")))
+	if err == nil || err.Error() != "ERR no such key" {
+		t.Errorf("unexpected error:%v", err)
+	}
+}